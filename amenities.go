@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Amenity string
+
+const (
+	AmenityCarWash    Amenity = "car_wash"
+	AmenityShop       Amenity = "shop"
+	AmenityRestaurant Amenity = "restaurant"
+	AmenityToilets    Amenity = "toilets"
+	AmenityEVCharger  Amenity = "ev_charger"
+	AmenityTruckLane  Amenity = "truck_lane"
+	AmenityTyreAir    Amenity = "tyre_air"
+)
+
+type EVConnector struct {
+	Type    string  `json:"type"`
+	PowerKw float64 `json:"power_kw"`
+	Count   int     `json:"count"`
+}
+
+func ValidAmenity(a Amenity) bool {
+	return a == AmenityCarWash ||
+		a == AmenityShop ||
+		a == AmenityRestaurant ||
+		a == AmenityToilets ||
+		a == AmenityEVCharger ||
+		a == AmenityTruckLane ||
+		a == AmenityTyreAir
+}
+
+func ValidConnectorType(t string) bool {
+	return t == "type2" ||
+		t == "ccs" ||
+		t == "chademo" ||
+		t == "tesla"
+}
+
+// ValidateAmenities checks the amenities of a station, EV connectors are
+// only allowed on stations advertising an EV charger.
+func ValidateAmenities(amenities []Amenity, connectors []EVConnector) error {
+	for _, a := range amenities {
+		if !ValidAmenity(a) {
+			return fmt.Errorf("Invalid amenity %q", a)
+		}
+	}
+	if len(connectors) > 0 && !hasAmenity(amenities, AmenityEVCharger) {
+		return fmt.Errorf("EV connectors require the ev_charger amenity")
+	}
+	for _, c := range connectors {
+		if !ValidConnectorType(c.Type) {
+			return fmt.Errorf("Invalid connector type %q, expected type2, ccs, chademo or tesla", c.Type)
+		}
+		if c.PowerKw <= 0 || c.Count <= 0 {
+			return fmt.Errorf("Connector power and count must be positive")
+		}
+	}
+	return nil
+}
+
+func hasAmenity(amenities []Amenity, a Amenity) bool {
+	for _, am := range amenities {
+		if am == a {
+			return true
+		}
+	}
+	return false
+}
+
+func hasConnector(connectors []EVConnector, t string) bool {
+	for _, c := range connectors {
+		if c.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAmenities splits a list of amenities separated by sep.
+func ParseAmenities(s, sep string) []Amenity {
+	amenities := make([]Amenity, 0)
+	for _, a := range strings.Split(s, sep) {
+		if a = strings.TrimSpace(a); a != "" {
+			amenities = append(amenities, Amenity(a))
+		}
+	}
+	return amenities
+}
@@ -1,18 +1,35 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
     "strings"
+	"syscall"
+	"time"
 )
 
 type APIServer struct {
-	port    string
-	storage Storage
+	port       string
+	storage    Storage
+	audit      AuditStore
+	supervisor *GeneratorSupervisor
+	market     *Market
+	compactor  *HistoryCompactor
+	openData   *OpenDataImporter
+	purger     *TrashPurger
+	events     *EventLog
+	broker     Broker
+	elector    *LeaderElector
 }
 
 type APIError struct {
@@ -25,6 +42,7 @@ func jsonWriter(w http.ResponseWriter, status int, data interface{}) error {
 	w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Access-Control-Allow-Methods", "*")
     w.Header().Set("Access-Control-Allow-Headers", "*")
+    w.Header().Set("Access-Control-Expose-Headers", "ETag")
 	w.Header().Add("Content-Type", "application/json")
 	w.WriteHeader(status)
 	return json.NewEncoder(w).Encode(data)
@@ -33,7 +51,12 @@ func jsonWriter(w http.ResponseWriter, status int, data interface{}) error {
 func wrapApiHandleFunc(f apiFuncDef) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			jsonWriter(w, http.StatusBadRequest, APIError{Error: err.Error()})
+			status := http.StatusBadRequest
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) {
+				status = statusErr.Status
+			}
+			jsonWriter(w, status, APIError{Error: err.Error()})
 		}
 	}
 }
@@ -74,10 +97,39 @@ func wrapAuth(hFunc http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-func NewAPIServer(port string, storage Storage) *APIServer {
+func getJwtFromHeader(r *http.Request) string {
+    parts := strings.Split(r.Header.Get("Authorization"), " ")
+    if len(parts) != 2 {
+        return ""
+    }
+    return parts[1]
+}
+
+func wrapAdmin(hFunc http.HandlerFunc) http.HandlerFunc {
+	return wrapAuth(func(w http.ResponseWriter, r *http.Request) {
+        email, err := GetJwtEmail(getJwtFromHeader(r))
+        if err != nil || email != os.Getenv("ADMIN_EMAIL") {
+            jsonWriter(w, http.StatusForbidden, APIError{Error: "Forbidden"})
+            return
+        }
+
+        hFunc(w, r)
+	})
+}
+
+func NewAPIServer(port string, storage Storage, audit AuditStore, supervisor *GeneratorSupervisor, market *Market, compactor *HistoryCompactor, openData *OpenDataImporter, purger *TrashPurger, events *EventLog, broker Broker, elector *LeaderElector) *APIServer {
 	return &APIServer{
-		port:    port,
-		storage: storage,
+		port:       port,
+		storage:    storage,
+		audit:      audit,
+		supervisor: supervisor,
+		market:     market,
+		compactor:  compactor,
+		openData:   openData,
+		purger:     purger,
+		events:     events,
+		broker:     broker,
+		elector:    elector,
 	}
 }
 
@@ -97,28 +149,106 @@ func (s *APIServer) Start() {
 	router.HandleFunc("GET /user", wrapAuth(wrapApiHandleFunc(s.handleGetUsers)))
 	router.HandleFunc("GET /user/{id}", wrapAuth(wrapApiHandleFunc(s.handleGetUserById)))
 	router.HandleFunc("POST /user", wrapAuth(wrapApiHandleFunc(s.handleCreateUser)))
-	router.HandleFunc("PUT /user", wrapAuth(wrapApiHandleFunc(s.handleUpdateUser)))
+	router.HandleFunc("PUT /user/{id}", wrapAuth(wrapApiHandleFunc(s.handleUpdateUser)))
 	router.HandleFunc("DELETE /user/{id}", wrapAuth(wrapApiHandleFunc(s.handleDeleteUser)))
 
     router.HandleFunc("GET /station", wrapAuth(wrapApiHandleFunc(s.handleGetStations)))
     router.HandleFunc("GET /station/{id}", wrapAuth(wrapApiHandleFunc(s.handleGetStationById)))
     router.HandleFunc("POST /station", wrapAuth(wrapApiHandleFunc(s.handleCreateStation)))
-    router.HandleFunc("PUT /station", wrapAuth(wrapApiHandleFunc(s.handleUpdateStation)))
+    router.HandleFunc("POST /station/import", wrapAuth(wrapApiHandleFunc(s.handleImportStations)))
+    router.HandleFunc("PUT /station/{id}", wrapAuth(wrapApiHandleFunc(s.handleUpdateStation)))
+    router.HandleFunc("PATCH /station/{id}", wrapAuth(wrapApiHandleFunc(s.handlePatchStation)))
     router.HandleFunc("DELETE /station/{id}", wrapAuth(wrapApiHandleFunc(s.handleDeleteStation)))
 
     router.HandleFunc("GET /prices/history/{id}/{gasType}", wrapAuth(wrapApiHandleFunc(s.handleGetHistoryPrices)))
     router.HandleFunc("POST /prices/location", wrapAuth(wrapApiHandleFunc(s.handleGetPricesByLocation)))
+    router.HandleFunc("PUT /prices/{id}", wrapAuth(wrapApiHandleFunc(s.handleSubmitPrices)))
+    router.HandleFunc("GET /prices/caps", wrapAuth(wrapApiHandleFunc(s.handleGetActivePriceCaps)))
+
+    router.HandleFunc("GET /events", wrapAuth(wrapApiHandleFunc(s.handleGetEvents)))
+    router.HandleFunc("GET /events/stream", wrapAuth(wrapApiHandleFunc(s.handleStreamEvents)))
+
+    router.HandleFunc("GET /brands", wrapAuth(wrapApiHandleFunc(s.handleGetBrands)))
+    router.HandleFunc("GET /brands/{id}", wrapAuth(wrapApiHandleFunc(s.handleGetBrandById)))
+    router.HandleFunc("PUT /brands/{id}/prices", wrapAuth(wrapApiHandleFunc(s.handleSubmitBrandPrices)))
+
+    router.HandleFunc("GET /fuels", wrapAuth(wrapApiHandleFunc(s.handleGetFuelTypes)))
+    router.HandleFunc("GET /fuels/{code}", wrapAuth(wrapApiHandleFunc(s.handleGetFuelType)))
+
+    router.HandleFunc("GET /regions", wrapAuth(wrapApiHandleFunc(s.handleGetRegions)))
+    router.HandleFunc("GET /regions/{id}", wrapAuth(wrapApiHandleFunc(s.handleGetRegionById)))
+
+    router.HandleFunc("GET /stats/prices", wrapAuth(wrapApiHandleFunc(s.handleGetPriceStats)))
+    router.HandleFunc("GET /stats/prices/history", wrapAuth(wrapApiHandleFunc(s.handleGetAveragePriceHistory)))
+    router.HandleFunc("GET /stats/brands", wrapAuth(wrapApiHandleFunc(s.handleGetBrandPriceStats)))
+
+    router.HandleFunc("GET /admin/generators", wrapAdmin(wrapApiHandleFunc(s.handleGetGenerators)))
+    router.HandleFunc("POST /admin/generators/{id}/pause", wrapAdmin(wrapApiHandleFunc(s.handlePauseGenerator)))
+    router.HandleFunc("POST /admin/generators/{id}/resume", wrapAdmin(wrapApiHandleFunc(s.handleResumeGenerator)))
+    router.HandleFunc("GET /admin/market", wrapAdmin(wrapApiHandleFunc(s.handleGetMarketFactors)))
+    router.HandleFunc("GET /admin/market/shocks", wrapAdmin(wrapApiHandleFunc(s.handleGetMarketShocks)))
+    router.HandleFunc("POST /admin/market/shocks", wrapAdmin(wrapApiHandleFunc(s.handleCreateMarketShock)))
+    router.HandleFunc("GET /admin/leader", wrapAdmin(wrapApiHandleFunc(s.handleGetLeader)))
+    router.HandleFunc("GET /admin/broker", wrapAdmin(wrapApiHandleFunc(s.handleGetBrokerStats)))
+    router.HandleFunc("GET /admin/compaction", wrapAdmin(wrapApiHandleFunc(s.handleGetCompactionStatus)))
+    router.HandleFunc("POST /admin/compaction", wrapAdmin(wrapApiHandleFunc(s.handleRunCompaction)))
+    router.HandleFunc("POST /admin/brands", wrapAdmin(wrapApiHandleFunc(s.handleCreateBrand)))
+    router.HandleFunc("PUT /admin/brands/{id}", wrapAdmin(wrapApiHandleFunc(s.handleUpdateBrand)))
+    router.HandleFunc("DELETE /admin/brands/{id}", wrapAdmin(wrapApiHandleFunc(s.handleDeleteBrand)))
+    router.HandleFunc("PUT /admin/users/{id}/brand", wrapAdmin(wrapApiHandleFunc(s.handleSetUserBrand)))
+    router.HandleFunc("POST /admin/fuels", wrapAdmin(wrapApiHandleFunc(s.handleCreateFuelType)))
+    router.HandleFunc("PUT /admin/fuels/{code}", wrapAdmin(wrapApiHandleFunc(s.handleUpdateFuelType)))
+    router.HandleFunc("DELETE /admin/fuels/{code}", wrapAdmin(wrapApiHandleFunc(s.handleDeleteFuelType)))
+    router.HandleFunc("POST /admin/regions", wrapAdmin(wrapApiHandleFunc(s.handleCreateRegion)))
+    router.HandleFunc("PUT /admin/regions/{id}", wrapAdmin(wrapApiHandleFunc(s.handleUpdateRegion)))
+    router.HandleFunc("DELETE /admin/regions/{id}", wrapAdmin(wrapApiHandleFunc(s.handleDeleteRegion)))
+    router.HandleFunc("GET /admin/audit", wrapAdmin(wrapApiHandleFunc(s.handleGetAuditEntries)))
+    router.HandleFunc("GET /admin/trash", wrapAdmin(wrapApiHandleFunc(s.handleGetTrash)))
+    router.HandleFunc("POST /admin/trash/purge", wrapAdmin(wrapApiHandleFunc(s.handlePurgeTrash)))
+    router.HandleFunc("POST /admin/trash/stations/{id}/restore", wrapAdmin(wrapApiHandleFunc(s.handleRestoreStation)))
+    router.HandleFunc("POST /admin/trash/users/{id}/restore", wrapAdmin(wrapApiHandleFunc(s.handleRestoreUser)))
+    router.HandleFunc("POST /admin/import/opendata", wrapAdmin(wrapApiHandleFunc(s.handleImportOpenData)))
+    router.HandleFunc("GET /admin/caps", wrapAdmin(wrapApiHandleFunc(s.handleGetPriceCaps)))
+    router.HandleFunc("POST /admin/caps", wrapAdmin(wrapApiHandleFunc(s.handleCreatePriceCap)))
+    router.HandleFunc("DELETE /admin/caps/{id}", wrapAdmin(wrapApiHandleFunc(s.handleDeletePriceCap)))
+
+	// Long polls and event streams end with this context so Shutdown
+	// does not wait for them.
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	defer cancelBase()
 
 	server := &http.Server{
 		Addr:      s.port,
 		Handler:   router,
 		TLSConfig: config,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
+	server.RegisterOnShutdown(cancelBase)
 
-	log.Println("Starting server on", s.port)
-	err = server.ListenAndServeTLS("", "")
-	if err != nil {
-		log.Fatalln("Failed to start server, err: ", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Println("Starting server on", s.port)
+		err := server.ListenAndServeTLS("", "")
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalln("Failed to start server, err: ", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down server")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Failed to shut down server, err: ", err)
+	}
+	if err := s.supervisor.Shutdown(shutdownCtx); err != nil {
+		log.Println("Failed to stop generators, err: ", err)
 	}
 }
 
@@ -164,6 +294,11 @@ func (s *APIServer) handleGetUserById(w http.ResponseWriter, r *http.Request) er
 		return err
 	}
 
+	etag := userETag(user)
+	if writeNotModified(w, r, etag) {
+		return nil
+	}
+	w.Header().Set("ETag", etag)
 	return jsonWriter(w, http.StatusOK, user)
 }
 
@@ -173,9 +308,11 @@ func (s *APIServer) handleCreateUser(w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 
-	if err := s.storage.CreateUser(userDto); err != nil {
+	user, err := s.storage.CreateUser(userDto)
+	if err != nil {
 		return err
 	}
+	s.recordAudit(r, AuditCreate, "user", user.ID, nil, userAuditView(user))
 
 	return jsonWriter(w, http.StatusCreated, "User created")
 }
@@ -186,16 +323,23 @@ func (s *APIServer) handleUpdateUser(w http.ResponseWriter, r *http.Request) err
         return err
     }
     
+    version, err := ifMatchVersion(r)
+    if err != nil {
+        return err
+    }
+
     userDto := new(UserDto)
     if err := json.NewDecoder(r.Body).Decode(userDto); err != nil {
         return err
     }
 
-    user, err := s.storage.UpdateUser(id, userDto)
+    before, user, err := s.storage.UpdateUser(id, version, userDto)
     if err != nil {
-        return err
+        return versionError(err)
     }
+    s.recordAudit(r, AuditUpdate, "user", id, userAuditView(before), userAuditView(user))
 
+    w.Header().Set("ETag", userETag(user))
     return jsonWriter(w, http.StatusOK, user)
 }
 
@@ -205,20 +349,52 @@ func (s *APIServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) err
         return err
     }
 
-	if err := s.storage.DeleteUser(id); err != nil {
-		return err
+    version, err := ifMatchVersion(r)
+    if err != nil {
+        return err
+    }
+
+	before, err := s.storage.DeleteUser(id, version)
+	if err != nil {
+		return versionError(err)
 	}
+    s.recordAudit(r, AuditDelete, "user", id, userAuditView(before), nil)
 
 	return jsonWriter(w, http.StatusOK, fmt.Sprintf("User with id %d deleted", id))
 }
 
 
 func (s *APIServer) handleGetStations(w http.ResponseWriter, r *http.Request) error {
-    stations, err := s.storage.GetStations()
+    filter, err := ParseStationFilter(r.URL.Query())
+    if err != nil {
+        return err
+    }
+
+    format, err := negotiateStationFormat(r)
+    if err != nil {
+        return err
+    }
+
+    stations, err := s.storage.GetStations(filter)
     if err != nil {
         return fmt.Errorf("Failed to get stations")
     }
 
+    switch format {
+    case "geojson":
+        body, err := json.Marshal(NewGeoJSONFeatureCollection(stations))
+        if err != nil {
+            return err
+        }
+        return rawWriter(w, http.StatusOK, ContentTypeGeoJSON, body)
+    case "kml":
+        body, err := NewKMLDocument(stations)
+        if err != nil {
+            return err
+        }
+        return rawWriter(w, http.StatusOK, ContentTypeKML, body)
+    }
+
     return jsonWriter(w, http.StatusOK, stations)
 }
 
@@ -233,6 +409,11 @@ func (s *APIServer) handleGetStationById(w http.ResponseWriter, r *http.Request)
         return err
     }
 
+    etag := stationETag(station)
+    if writeNotModified(w, r, etag) {
+        return nil
+    }
+    w.Header().Set("ETag", etag)
     return jsonWriter(w, http.StatusOK, station)
 }
 
@@ -242,8 +423,118 @@ func (s *APIServer) handleCreateStation(w http.ResponseWriter, r *http.Request)
         return err
     }
 
+    if err := ValidateStationDto(s.storage, stationDto); err != nil {
+        return err
+    }
+
+    station, err := s.storage.CreateStation(stationDto)
+    if err != nil {
+        return err
+    }
+    s.recordAudit(r, AuditCreate, "station", station.ID, nil, station.Dto())
+
+    return jsonWriter(w, http.StatusCreated, "Station created")
+}
+
+func (s *APIServer) handleImportStations(w http.ResponseWriter, r *http.Request) error {
+    q := r.URL.Query()
+
+    mode := q.Get("mode")
+    if mode == "" {
+        mode = ImportAtomic
+    }
+    if !ValidImportMode(mode) {
+        return fmt.Errorf("Invalid import mode, expected atomic or best_effort")
+    }
+
+    format := q.Get("format")
+    if format == "" {
+        format = "json"
+        if strings.Contains(r.Header.Get("Content-Type"), "csv") {
+            format = "csv"
+        }
+    }
+
+    rows, err := ParseStationsImport(r.Body, format)
+    if err != nil {
+        return err
+    }
+
+    result := NewImportResultDto(mode, q.Get("dry_run") == "true")
+    result.Total = len(rows)
+
+    valid := make([]*ImportRow, 0, len(rows))
+    for _, row := range rows {
+        if row.Err == nil {
+            row.Err = ValidateStationDto(s.storage, row.Station)
+        }
+        if row.Err != nil {
+            result.Errors = append(result.Errors, ImportRowErrorDto{Row: row.Row, Error: row.Err.Error()})
+            continue
+        }
+        valid = append(valid, row)
+    }
+    result.Valid = len(valid)
+    result.Failed = len(result.Errors)
+
+    if result.DryRun {
+        return jsonWriter(w, http.StatusOK, result)
+    }
+
+    if mode == ImportAtomic {
+        if result.Failed > 0 {
+            return jsonWriter(w, http.StatusBadRequest, result)
+        }
+        dtos := make([]*StationDto, len(valid))
+        for i, row := range valid {
+            dtos[i] = row.Station
+        }
+        ids, err := s.storage.CreateStations(dtos)
+        if err != nil {
+            return err
+        }
+        for i, id := range ids {
+            s.recordAudit(r, AuditImport, "station", id, nil, dtos[i])
+        }
+        result.Stations = ids
+        result.Created = len(ids)
+        return jsonWriter(w, http.StatusCreated, result)
+    }
+
+    for _, row := range valid {
+        ids, err := s.storage.CreateStations([]*StationDto{row.Station})
+        if err != nil {
+            result.Errors = append(result.Errors, ImportRowErrorDto{Row: row.Row, Error: err.Error()})
+            result.Failed++
+            continue
+        }
+        s.recordAudit(r, AuditImport, "station", ids[0], nil, row.Station)
+        result.Stations = append(result.Stations, ids...)
+        result.Created++
+    }
+
+    return jsonWriter(w, http.StatusOK, result)
+}
+
+// ValidateStationDto checks the station against its brand, the fuel catalog
+// and the active price caps of its regions.
+func ValidateStationDto(storage Storage, stationDto *StationDto) error {
+    if stationDto.BrandID != 0 {
+        if _, err := storage.GetBrandByID(stationDto.BrandID); err != nil {
+            return err
+        }
+    }
+    if stationDto.Hours != nil {
+        if err := stationDto.Hours.Validate(); err != nil {
+            return err
+        }
+    }
+    if err := ValidateAmenities(stationDto.Amenities, stationDto.EVConnectors); err != nil {
+        return err
+    }
+
     for _, fuel := range stationDto.SupportedFuel {
-        if !ValidGasType(string(fuel)) {
+        if !storage.ValidFuelType(fuel) {
             return fmt.Errorf("Invalid fuel type")
         }
     }
@@ -264,12 +555,15 @@ func (s *APIServer) handleCreateStation(w http.ResponseWriter, r *http.Request)
         }
     }
 
-    err := s.storage.CreateStation(stationDto)
+    caps, err := storage.GetActivePriceCaps()
     if err != nil {
         return err
     }
-
-    return jsonWriter(w, http.StatusCreated, "Station created")
+    regions, err := storage.GetRegionsForLocation(&stationDto.Location)
+    if err != nil {
+        return err
+    }
+    return ValidatePriceCaps(caps, stationDto.CurrentPrice, regions)
 }
 
 func (s *APIServer) handleUpdateStation(w http.ResponseWriter, r *http.Request) error {
@@ -278,28 +572,121 @@ func (s *APIServer) handleUpdateStation(w http.ResponseWriter, r *http.Request)
         return err
     }
 
+    version, err := ifMatchVersion(r)
+    if err != nil {
+        return err
+    }
+
     stationDto := new(StationDto)
     if err := json.NewDecoder(r.Body).Decode(stationDto); err != nil {
         return err
     }
 
-    if err := s.storage.UpdateStation(id, stationDto); err != nil {
+    station, err := s.saveStation(r, AuditUpdate, id, version, stationDto)
+    if err != nil {
         return err
     }
 
+    w.Header().Set("ETag", stationETag(station))
     return jsonWriter(w, http.StatusOK, "Station updated")
 }
 
+// handlePatchStation applies a JSON Merge Patch to the station. When the
+// patch drops supported fuels without touching prices, the prices of the
+// dropped fuels are removed with them.
+func (s *APIServer) handlePatchStation(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    version, err := ifMatchVersion(r)
+    if err != nil {
+        return err
+    }
+
+    patch, err := io.ReadAll(r.Body)
+    if err != nil {
+        return err
+    }
+    patchFields := make(map[string]json.RawMessage)
+    if err := json.Unmarshal(patch, &patchFields); err != nil {
+        return fmt.Errorf("Invalid merge patch, expected a JSON object")
+    }
+
+    station, err := s.storage.GetStationByID(id)
+    if err != nil {
+        return err
+    }
+    if err := checkVersion(version, station.Version); err != nil {
+        return versionError(err)
+    }
+    // The patch is merged onto the station read above, a write in between
+    // must fail rather than be overwritten.
+    if version == 0 {
+        version = station.Version
+    }
+
+    doc, err := json.Marshal(station.Dto())
+    if err != nil {
+        return err
+    }
+    patched, err := ApplyMergePatch(doc, patch)
+    if err != nil {
+        return err
+    }
+    stationDto := new(StationDto)
+    if err := json.Unmarshal(patched, stationDto); err != nil {
+        return fmt.Errorf("Invalid merge patch: %v", err)
+    }
+
+    // Without prices the current ones are kept as they are when stored,
+    // not as they were read.
+    if _, ok := patchFields["prices"]; !ok {
+        stationDto.CurrentPrice = nil
+    }
+
+    station, err = s.saveStation(r, AuditPatch, id, version, stationDto)
+    if err != nil {
+        return err
+    }
+
+    w.Header().Set("ETag", stationETag(station))
+    return jsonWriter(w, http.StatusOK, station)
+}
+
+// saveStation validates and stores the new station fields, records an
+// audit entry of the fields that changed and returns the updated station.
+func (s *APIServer) saveStation(r *http.Request, action string, id, version uint64, stationDto *StationDto) (*StationView, error) {
+    if err := ValidateStationDto(s.storage, stationDto); err != nil {
+        return nil, err
+    }
+
+    before, after, err := s.storage.UpdateStation(id, version, stationDto)
+    if err != nil {
+        return nil, versionError(err)
+    }
+    s.recordAudit(r, action, "station", id, before.Dto(), after.Dto())
+    return after, nil
+}
+
 func (s *APIServer) handleDeleteStation(w http.ResponseWriter, r *http.Request) error {
     id, err := getIdFromPath(r)
     if err != nil {
         return err
     }
 
-    if err := s.storage.DeleteStation(id); err != nil {
+    version, err := ifMatchVersion(r)
+    if err != nil {
         return err
     }
 
+    before, err := s.storage.DeleteStation(id, version)
+    if err != nil {
+        return versionError(err)
+    }
+    s.recordAudit(r, AuditDelete, "station", id, before.Dto(), nil)
+
     return jsonWriter(w, http.StatusOK, fmt.Sprintf("Station with id %d deleted", id))
 }
 
@@ -314,12 +701,34 @@ func (s *APIServer) handleGetHistoryPrices(w http.ResponseWriter, r *http.Reques
         return fmt.Errorf("Gas type is required")
     }
 
-    prices, err := s.storage.GetHistoryPrices(id, gasType)
+    from, to, err := ParseTimeRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
     if err != nil {
         return err
     }
 
-    return jsonWriter(w, http.StatusOK, prices)
+    points, err := s.storage.GetHistoryPrices(id, gasType, from, to)
+    if err != nil {
+        return err
+    }
+
+    histPrices := &HistPriceGasTypeDto{
+        GasType: GasType(gasType),
+    }
+
+    bucket := r.URL.Query().Get("bucket")
+    if bucket == "" {
+        histPrices.HistoryPrices = points
+        return jsonWriter(w, http.StatusOK, histPrices)
+    }
+
+    size, err := ParseDayDuration(bucket)
+    if err != nil {
+        return err
+    }
+    histPrices.Bucket = bucket
+    histPrices.Buckets = AggregatePricePoints(points, size)
+
+    return jsonWriter(w, http.StatusOK, histPrices)
 }
 
 func (s *APIServer) handleGetPricesByLocation(w http.ResponseWriter, r *http.Request) error {
@@ -327,8 +736,13 @@ func (s *APIServer) handleGetPricesByLocation(w http.ResponseWriter, r *http.Req
     if err := json.NewDecoder(r.Body).Decode(loc); err != nil {
         return err
     }
+
+    filter, err := ParseStationFilter(r.URL.Query())
+    if err != nil {
+        return err
+    }
     
-    prices, err := s.storage.GetPricesByLocation(loc)
+    prices, err := s.storage.GetPricesByLocation(loc, filter)
     if err != nil {
         return nil
     }
@@ -336,3 +750,722 @@ func (s *APIServer) handleGetPricesByLocation(w http.ResponseWriter, r *http.Req
     return jsonWriter(w, http.StatusOK, prices)
 }
 
+
+func (s *APIServer) handleGetGenerators(w http.ResponseWriter, r *http.Request) error {
+    return jsonWriter(w, http.StatusOK, s.supervisor.Status())
+}
+
+func (s *APIServer) handlePauseGenerator(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    if err := s.supervisor.Pause(id); err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, fmt.Sprintf("Generator for station with id %d paused", id))
+}
+
+func (s *APIServer) handleResumeGenerator(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    if err := s.supervisor.Resume(id); err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, fmt.Sprintf("Generator for station with id %d resumed", id))
+}
+
+func (s *APIServer) handleGetMarketFactors(w http.ResponseWriter, r *http.Request) error {
+    return jsonWriter(w, http.StatusOK, s.market.GetFactors())
+}
+
+func (s *APIServer) handleGetMarketShocks(w http.ResponseWriter, r *http.Request) error {
+    return jsonWriter(w, http.StatusOK, s.market.GetShocks())
+}
+
+func (s *APIServer) handleCreateMarketShock(w http.ResponseWriter, r *http.Request) error {
+    shockDto := new(MarketShockDto)
+    if err := json.NewDecoder(r.Body).Decode(shockDto); err != nil {
+        return err
+    }
+
+    if !s.storage.ValidFuelType(shockDto.GasType) {
+        return fmt.Errorf("Invalid gas type")
+    }
+
+    shock, err := s.market.AddShock(shockDto)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusCreated, shock)
+}
+
+// handleSubmitPrices lets an operator of the station's brand, or the admin,
+// set some of the station's prices.
+func (s *APIServer) handleSubmitPrices(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    email, err := GetJwtEmail(getJwtFromHeader(r))
+    if err != nil {
+        return err
+    }
+    var brandID uint64
+    if email != os.Getenv("ADMIN_EMAIL") {
+        user, err := s.storage.GetUserByEmail(email)
+        if err != nil {
+            return err
+        }
+        if user.BrandID == 0 {
+            return NewStatusError(http.StatusForbidden, ErrNotStationOperator)
+        }
+        brandID = user.BrandID
+    }
+
+    prices := make(map[GasType]float64)
+    if err := json.NewDecoder(r.Body).Decode(&prices); err != nil {
+        return err
+    }
+
+    before, after, err := s.storage.SubmitPrices(id, brandID, prices)
+    if errors.Is(err, ErrNotStationOperator) {
+        return NewStatusError(http.StatusForbidden, err)
+    }
+    if err != nil {
+        return err
+    }
+    s.recordAudit(r, AuditUpdate, "price", id, before.Prices, after.Prices)
+
+    return jsonWriter(w, http.StatusOK, "Prices updated")
+}
+
+func (s *APIServer) handleGetActivePriceCaps(w http.ResponseWriter, r *http.Request) error {
+    caps, err := s.storage.GetActivePriceCaps()
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, caps)
+}
+
+func (s *APIServer) handleGetPriceCaps(w http.ResponseWriter, r *http.Request) error {
+    caps, err := s.storage.GetPriceCaps()
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, caps)
+}
+
+func (s *APIServer) handleCreatePriceCap(w http.ResponseWriter, r *http.Request) error {
+    capDto := new(PriceCapDto)
+    if err := json.NewDecoder(r.Body).Decode(capDto); err != nil {
+        return err
+    }
+
+    priceCap, err := s.storage.CreatePriceCap(capDto)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusCreated, priceCap)
+}
+
+func (s *APIServer) handleDeletePriceCap(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    if err := s.storage.DeletePriceCap(id); err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, fmt.Sprintf("Price cap with id %d deleted", id))
+}
+
+func (s *APIServer) handleGetLeader(w http.ResponseWriter, r *http.Request) error {
+    if s.elector == nil {
+        return jsonWriter(w, http.StatusOK, &LeaderStatusDto{IsLeader: true, Standalone: true})
+    }
+    status, err := s.elector.Status()
+    if err != nil {
+        return err
+    }
+    return jsonWriter(w, http.StatusOK, status)
+}
+
+func (s *APIServer) handleGetBrokerStats(w http.ResponseWriter, r *http.Request) error {
+    return jsonWriter(w, http.StatusOK, s.broker.Stats())
+}
+
+func (s *APIServer) handleGetCompactionStatus(w http.ResponseWriter, r *http.Request) error {
+    return jsonWriter(w, http.StatusOK, s.compactor.Status())
+}
+
+func (s *APIServer) handleRunCompaction(w http.ResponseWriter, r *http.Request) error {
+    stats, err := s.compactor.RunOnce()
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, stats)
+}
+
+func (s *APIServer) handleGetPriceStats(w http.ResponseWriter, r *http.Request) error {
+    filter, err := ParseStationFilter(r.URL.Query())
+    if err != nil {
+        return err
+    }
+
+    stats, err := s.storage.GetPriceStats(filter, r.URL.Query().Get("gas_type"))
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, stats)
+}
+
+func (s *APIServer) handleGetAveragePriceHistory(w http.ResponseWriter, r *http.Request) error {
+    q := r.URL.Query()
+    filter, err := ParseStationFilter(q)
+    if err != nil {
+        return err
+    }
+
+    gasType := q.Get("gas_type")
+    if gasType == "" {
+        return fmt.Errorf("Gas type is required")
+    }
+
+    from, to, err := ParseTimeRange(q.Get("from"), q.Get("to"))
+    if err != nil {
+        return err
+    }
+
+    bucket := q.Get("bucket")
+    if bucket == "" {
+        bucket = "1d"
+    }
+    size, err := ParseDayDuration(bucket)
+    if err != nil {
+        return err
+    }
+
+    buckets, err := s.storage.GetAveragePriceHistory(filter, gasType, from, to, size)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, buckets)
+}
+
+func (s *APIServer) handleGetRegions(w http.ResponseWriter, r *http.Request) error {
+    regions, err := s.storage.GetRegions()
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, regions)
+}
+
+func (s *APIServer) handleGetRegionById(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    region, err := s.storage.GetRegionByID(id)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, region)
+}
+
+func (s *APIServer) handleCreateRegion(w http.ResponseWriter, r *http.Request) error {
+    regionDto := new(RegionDto)
+    if err := json.NewDecoder(r.Body).Decode(regionDto); err != nil {
+        return err
+    }
+
+    region, err := s.storage.CreateRegion(regionDto)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusCreated, region)
+}
+
+func (s *APIServer) handleUpdateRegion(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    regionDto := new(RegionDto)
+    if err := json.NewDecoder(r.Body).Decode(regionDto); err != nil {
+        return err
+    }
+
+    region, err := s.storage.UpdateRegion(id, regionDto)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, region)
+}
+
+func (s *APIServer) handleDeleteRegion(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    if err := s.storage.DeleteRegion(id); err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, fmt.Sprintf("Region with id %d deleted", id))
+}
+
+func (s *APIServer) handleImportOpenData(w http.ResponseWriter, r *http.Request) error {
+    actor, _ := GetJwtEmail(getJwtFromHeader(r))
+    result, err := s.openData.ImportURL(actor, clientIP(r))
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, result)
+}
+
+func (s *APIServer) handleGetFuelTypes(w http.ResponseWriter, r *http.Request) error {
+    fuelTypes, err := s.storage.GetFuelTypes()
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, fuelTypes)
+}
+
+func (s *APIServer) handleGetFuelType(w http.ResponseWriter, r *http.Request) error {
+    fuelType, err := s.storage.GetFuelType(GasType(r.PathValue("code")))
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, fuelType)
+}
+
+func (s *APIServer) handleCreateFuelType(w http.ResponseWriter, r *http.Request) error {
+    fuelTypeDto := new(FuelTypeDto)
+    if err := json.NewDecoder(r.Body).Decode(fuelTypeDto); err != nil {
+        return err
+    }
+
+    fuelType, err := s.storage.CreateFuelType(fuelTypeDto)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusCreated, fuelType)
+}
+
+func (s *APIServer) handleUpdateFuelType(w http.ResponseWriter, r *http.Request) error {
+    fuelTypeDto := new(FuelTypeDto)
+    if err := json.NewDecoder(r.Body).Decode(fuelTypeDto); err != nil {
+        return err
+    }
+
+    fuelType, err := s.storage.UpdateFuelType(GasType(r.PathValue("code")), fuelTypeDto)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, fuelType)
+}
+
+func (s *APIServer) handleDeleteFuelType(w http.ResponseWriter, r *http.Request) error {
+    code := r.PathValue("code")
+    if err := s.storage.DeleteFuelType(GasType(code)); err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, fmt.Sprintf("Fuel type %s deleted", code))
+}
+
+func (s *APIServer) handleGetBrands(w http.ResponseWriter, r *http.Request) error {
+    brands, err := s.storage.GetBrands()
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, brands)
+}
+
+func (s *APIServer) handleGetBrandById(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    brand, err := s.storage.GetBrandByID(id)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, brand)
+}
+
+func (s *APIServer) handleCreateBrand(w http.ResponseWriter, r *http.Request) error {
+    brandDto := new(BrandDto)
+    if err := json.NewDecoder(r.Body).Decode(brandDto); err != nil {
+        return err
+    }
+
+    brand, err := s.storage.CreateBrand(brandDto)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusCreated, brand)
+}
+
+func (s *APIServer) handleUpdateBrand(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    brandDto := new(BrandDto)
+    if err := json.NewDecoder(r.Body).Decode(brandDto); err != nil {
+        return err
+    }
+
+    brand, err := s.storage.UpdateBrand(id, brandDto)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, brand)
+}
+
+func (s *APIServer) handleDeleteBrand(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    if err := s.storage.DeleteBrand(id); err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, fmt.Sprintf("Brand with id %d deleted", id))
+}
+
+func (s *APIServer) handleSetUserBrand(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    userBrandDto := new(UserBrandDto)
+    if err := json.NewDecoder(r.Body).Decode(userBrandDto); err != nil {
+        return err
+    }
+
+    before, user, err := s.storage.SetUserBrand(id, userBrandDto.BrandID)
+    if err != nil {
+        return err
+    }
+    s.recordAudit(r, AuditUpdate, "user", id, userAuditView(before), userAuditView(user))
+
+    return jsonWriter(w, http.StatusOK, user)
+}
+
+// handleSubmitBrandPrices lets an operator of the chain, or the admin, set
+// one price list on every station of the brand.
+func (s *APIServer) handleSubmitBrandPrices(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    email, err := GetJwtEmail(getJwtFromHeader(r))
+    if err != nil {
+        return err
+    }
+    if email != os.Getenv("ADMIN_EMAIL") {
+        user, err := s.storage.GetUserByEmail(email)
+        if err != nil {
+            return err
+        }
+        if user.BrandID != id {
+            return NewStatusError(http.StatusForbidden, fmt.Errorf("User is not an operator of brand with id %d", id))
+        }
+    }
+
+    prices := make(map[GasType]float64)
+    if err := json.NewDecoder(r.Body).Decode(&prices); err != nil {
+        return err
+    }
+    if len(prices) == 0 {
+        return fmt.Errorf("Prices are required")
+    }
+    for k, v := range prices {
+        if !s.storage.ValidFuelType(k) {
+            return fmt.Errorf("Invalid fuel type")
+        }
+        if v < 0 {
+            return fmt.Errorf("Invalid price, has negative value")
+        }
+    }
+
+    changes, err := s.storage.RecordBrandPrice(id, prices)
+    if err != nil {
+        return err
+    }
+    ids := make([]uint64, len(changes))
+    for i, c := range changes {
+        s.recordAudit(r, AuditUpdate, "price", c.StationID, c.Before.Prices, c.After.Prices)
+        ids[i] = c.StationID
+    }
+
+    return jsonWriter(w, http.StatusOK, ids)
+}
+
+func (s *APIServer) handleGetBrandPriceStats(w http.ResponseWriter, r *http.Request) error {
+    filter, err := ParseStationFilter(r.URL.Query())
+    if err != nil {
+        return err
+    }
+
+    stats, err := s.storage.GetBrandPriceStats(filter, r.URL.Query().Get("gas_type"))
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, stats)
+}
+
+func (s *APIServer) handleGetTrash(w http.ResponseWriter, r *http.Request) error {
+    stations, err := s.storage.GetDeletedStations()
+    if err != nil {
+        return err
+    }
+    users, err := s.storage.GetDeletedUsers()
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, &TrashDto{
+        Grace:    s.purger.Grace().String(),
+        Stations: stations,
+        Users:    users,
+        Last:     s.purger.Last(),
+    })
+}
+
+func (s *APIServer) handlePurgeTrash(w http.ResponseWriter, r *http.Request) error {
+    actor, _ := GetJwtEmail(getJwtFromHeader(r))
+    stats, err := s.purger.RunOnce(actor, clientIP(r))
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, stats)
+}
+
+func (s *APIServer) handleRestoreStation(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    station, err := s.storage.RestoreStation(id)
+    if err != nil {
+        return err
+    }
+    s.recordAudit(r, AuditRestore, "station", id, nil, station.Dto())
+
+    w.Header().Set("ETag", stationETag(station))
+    return jsonWriter(w, http.StatusOK, station)
+}
+
+func (s *APIServer) handleRestoreUser(w http.ResponseWriter, r *http.Request) error {
+    id, err := getIdFromPath(r)
+    if err != nil {
+        return err
+    }
+
+    user, err := s.storage.RestoreUser(id)
+    if err != nil {
+        return err
+    }
+    s.recordAudit(r, AuditRestore, "user", id, nil, userAuditView(user))
+
+    w.Header().Set("ETag", userETag(user))
+    return jsonWriter(w, http.StatusOK, user)
+}
+
+// recordAudit logs failures instead of returning them since the audited
+// change has already been made.
+func (s *APIServer) recordAudit(r *http.Request, action, resource string, id uint64, before, after interface{}) {
+    actor, _ := GetJwtEmail(getJwtFromHeader(r))
+    writeAudit(s.audit, actor, clientIP(r), action, resource, id, before, after)
+}
+
+func (s *APIServer) handleGetAuditEntries(w http.ResponseWriter, r *http.Request) error {
+    filter, err := ParseAuditFilter(r.URL.Query())
+    if err != nil {
+        return err
+    }
+
+    page, err := s.audit.GetAuditEntries(filter)
+    if err != nil {
+        return err
+    }
+
+    return jsonWriter(w, http.StatusOK, page)
+}
+
+// parseEventsQuery reads after, station and limit. after defaults to the
+// Last-Event-ID header so reconnecting event streams resume by themselves.
+// after is <epoch>:<seq>, or a bare seq of the current epoch. A cursor of
+// another epoch answers 409, the client has to start over.
+func parseEventsQuery(r *http.Request, events *EventLog) (uint64, uint64, int, error) {
+    q := r.URL.Query()
+    after := q.Get("after")
+    if after == "" {
+        after = r.Header.Get("Last-Event-ID")
+    }
+
+    var seq, stationID uint64
+    var err error
+    if after != "" {
+        if epoch, s, ok := strings.Cut(after, ":"); ok {
+            if epoch != events.Epoch() {
+                return 0, 0, 0, NewStatusError(http.StatusConflict, fmt.Errorf("Event epoch %s is not the current epoch %s, start over", epoch, events.Epoch()))
+            }
+            after = s
+        }
+        seq, err = strconv.ParseUint(after, 10, 64)
+        if err != nil {
+            return 0, 0, 0, fmt.Errorf("Invalid after sequence number")
+        }
+    }
+    if v := q.Get("station"); v != "" {
+        stationID, err = strconv.ParseUint(v, 10, 64)
+        if err != nil {
+            return 0, 0, 0, fmt.Errorf("Invalid station id")
+        }
+    }
+
+    limit := 100
+    if v := q.Get("limit"); v != "" {
+        limit, err = strconv.Atoi(v)
+        if err != nil || limit <= 0 || limit > 1000 {
+            return 0, 0, 0, fmt.Errorf("Invalid limit, expected 1 to 1000")
+        }
+    }
+    return seq, stationID, limit, nil
+}
+
+// eventsError answers 410 for events evicted from the log, which clients
+// cannot get back, and 400 for anything else such as a future seq.
+func eventsError(err error) error {
+    if errors.Is(err, ErrEventsEvicted) {
+        return NewStatusError(http.StatusGone, err)
+    }
+    return err
+}
+
+// handleGetEvents returns the price events after the given sequence number.
+// With wait=<duration> it long polls until an event arrives or the wait
+// times out, up to a minute.
+func (s *APIServer) handleGetEvents(w http.ResponseWriter, r *http.Request) error {
+    seq, stationID, limit, err := parseEventsQuery(r, s.events)
+    if err != nil {
+        return err
+    }
+
+    var wait time.Duration
+    if v := r.URL.Query().Get("wait"); v != "" {
+        wait, err = time.ParseDuration(v)
+        if err != nil || wait < 0 || wait > time.Minute {
+            return fmt.Errorf("Invalid wait, expected a duration up to 1m")
+        }
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), wait)
+    defer cancel()
+    for {
+        page, err := s.events.After(seq, stationID, limit)
+        if err != nil {
+            return eventsError(err)
+        }
+        if len(page.Events) > 0 || ctx.Err() != nil {
+            return jsonWriter(w, http.StatusOK, page)
+        }
+        // Events of other stations only move the cursor.
+        seq = page.LastSeq
+        s.events.Wait(ctx, seq)
+    }
+}
+
+// handleStreamEvents sends the price events as server-sent events with the
+// sequence number as event id.
+func (s *APIServer) handleStreamEvents(w http.ResponseWriter, r *http.Request) error {
+    seq, stationID, limit, err := parseEventsQuery(r, s.events)
+    if err != nil {
+        return err
+    }
+    if r.URL.Query().Get("after") == "" && r.Header.Get("Last-Event-ID") == "" {
+        seq = s.events.LastSeq()
+    }
+    if _, err := s.events.After(seq, stationID, limit); err != nil {
+        return eventsError(err)
+    }
+
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        return fmt.Errorf("Streaming is not supported")
+    }
+
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.WriteHeader(http.StatusOK)
+    flusher.Flush()
+
+    ctx := r.Context()
+    for ctx.Err() == nil {
+        page, err := s.events.After(seq, stationID, limit)
+        if err != nil {
+            fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+            flusher.Flush()
+            return nil
+        }
+        for _, e := range page.Events {
+            data, err := json.Marshal(e)
+            if err != nil {
+                return nil
+            }
+            fmt.Fprintf(w, "id: %s:%d\nevent: price\ndata: %s\n\n", s.events.Epoch(), e.Seq, data)
+        }
+        flusher.Flush()
+
+        seq = page.LastSeq
+        s.events.Wait(ctx, seq)
+    }
+    return nil
+}
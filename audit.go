@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AuditCreate  = "create"
+	AuditUpdate  = "update"
+	AuditPatch   = "patch"
+	AuditDelete  = "delete"
+	AuditRestore = "restore"
+	AuditImport  = "import"
+	AuditPurge   = "purge"
+)
+
+// AuditSystemActor is the actor of changes made by background jobs.
+const AuditSystemActor = "system"
+
+type AuditEntry struct {
+	ID         uint64           `json:"id"`
+	Time       time.Time        `json:"time"`
+	Actor      string           `json:"actor"`
+	IP         string           `json:"ip"`
+	Action     string           `json:"action"`
+	Resource   string           `json:"resource"`
+	ResourceID uint64           `json:"resource_id"`
+	Changes    []FieldChangeDto `json:"changes"`
+}
+
+// AuditFilter narrows audit entries, zero fields do not filter.
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	Resource   string
+	ResourceID uint64
+	From       time.Time
+	To         time.Time
+	Offset     int
+	Limit      int
+}
+
+type AuditPageDto struct {
+	Total   int           `json:"total"`
+	Offset  int           `json:"offset"`
+	Limit   int           `json:"limit"`
+	Entries []*AuditEntry `json:"entries"`
+}
+
+// AuditStore keeps the audit log apart from Storage so it can live in a
+// different backend than the data it describes.
+type AuditStore interface {
+	RecordAudit(*AuditEntry) error
+	GetAuditEntries(*AuditFilter) (*AuditPageDto, error)
+}
+
+type RAMAuditStore struct {
+	entries []*AuditEntry
+	nextID  uint64
+	clock   Clock
+	mu      sync.Mutex
+}
+
+func NewRAMAuditStore(clock Clock) *RAMAuditStore {
+	return &RAMAuditStore{
+		entries: make([]*AuditEntry, 0),
+		nextID:  1,
+		clock:   clock,
+	}
+}
+
+// NewAuditEntry diffs the JSON of before and after, either may be nil for
+// creations and deletions.
+func NewAuditEntry(actor, ip, action, resource string, resourceID uint64, before, after interface{}) (*AuditEntry, error) {
+	changes, err := DiffJSON(before, after)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditEntry{
+		Actor:      actor,
+		IP:         ip,
+		Action:     action,
+		Resource:   resource,
+		ResourceID: resourceID,
+		Changes:    changes,
+	}, nil
+}
+
+// writeAudit records the change in store. Updates that changed nothing are
+// skipped and failures only logged since the change itself is done.
+func writeAudit(store AuditStore, actor, ip, action, resource string, id uint64, before, after interface{}) {
+	entry, err := NewAuditEntry(actor, ip, action, resource, id, before, after)
+	if err != nil {
+		log.Println("Failed to record audit entry, err: ", err)
+		return
+	}
+	if len(entry.Changes) == 0 && (action == AuditUpdate || action == AuditPatch) {
+		return
+	}
+	if err := store.RecordAudit(entry); err != nil {
+		log.Println("Failed to record audit entry, err: ", err)
+	}
+}
+
+func (a *RAMAuditStore) RecordAudit(entry *AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cp := *entry
+	cp.ID = a.nextID
+	a.nextID++
+	if cp.Time.IsZero() {
+		cp.Time = a.clock.Now()
+	}
+	a.entries = append(a.entries, &cp)
+	return nil
+}
+
+// GetAuditEntries returns the matching entries newest first.
+func (a *RAMAuditStore) GetAuditEntries(filter *AuditFilter) (*AuditPageDto, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	matched := make([]*AuditEntry, 0)
+	for i := len(a.entries) - 1; i >= 0; i-- {
+		if filter.Matches(a.entries[i]) {
+			matched = append(matched, a.entries[i])
+		}
+	}
+
+	page := &AuditPageDto{
+		Total:   len(matched),
+		Offset:  filter.Offset,
+		Limit:   filter.Limit,
+		Entries: make([]*AuditEntry, 0),
+	}
+	for i := filter.Offset; i < len(matched) && i < filter.Offset+filter.Limit; i++ {
+		cp := *matched[i]
+		page.Entries = append(page.Entries, &cp)
+	}
+	return page, nil
+}
+
+func (f *AuditFilter) Matches(e *AuditEntry) bool {
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if f.Resource != "" && e.Resource != f.Resource {
+		return false
+	}
+	if f.ResourceID != 0 && e.ResourceID != f.ResourceID {
+		return false
+	}
+	return inTimeRange(e.Time, f.From, f.To)
+}
+
+// ParseAuditFilter reads actor, action, resource, resource_id, from, to,
+// offset and limit from the query string. limit defaults to 50.
+func ParseAuditFilter(q url.Values) (*AuditFilter, error) {
+	filter := &AuditFilter{
+		Actor:    q.Get("actor"),
+		Action:   q.Get("action"),
+		Resource: q.Get("resource"),
+		Limit:    50,
+	}
+
+	if v := q.Get("resource_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid resource_id")
+		}
+		filter.ResourceID = id
+	}
+
+	from, to, err := ParseTimeRange(q.Get("from"), q.Get("to"))
+	if err != nil {
+		return nil, err
+	}
+	filter.From = from
+	filter.To = to
+
+	if v := q.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("Invalid offset")
+		}
+		filter.Offset = offset
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > 500 {
+			return nil, fmt.Errorf("Invalid limit, expected 1 to 500")
+		}
+		filter.Limit = limit
+	}
+	return filter, nil
+}
+
+// clientIP returns the address of the peer, or the address X-Forwarded-For
+// gives when the peer is a trusted proxy. TRUSTED_PROXIES lists the
+// proxies as comma separated IPs or CIDRs. Proxies append the address
+// they saw, so the list is read from the right and the first untrusted
+// address is the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		host = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, p := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if cidr.Contains(ip) {
+				return true
+			}
+		} else if proxy := net.ParseIP(p); proxy != nil && proxy.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// userAuditView hides the password hash, a fingerprint of it still shows
+// when the password changed.
+func userAuditView(u *User) *User {
+	if u == nil {
+		return nil
+	}
+	cp := u.Copy()
+	if cp.CryptPassword != "" {
+		cp.CryptPassword = fmt.Sprintf("%x", sha256.Sum256([]byte(cp.CryptPassword)))[:12]
+	}
+	return cp
+}
@@ -4,6 +4,7 @@ import (
     "golang.org/x/crypto/bcrypt"
 	"encoding/json"
     "encoding/base64"
+    "fmt"
     "strconv"
     "crypto/hmac"
     "crypto/sha256"
@@ -80,3 +81,21 @@ func ValidateJwt(token string) bool {
     return signature == GenerateJwtSignature(parts[0], parts[1])
 }
 
+
+func GetJwtEmail(token string) (string, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return "", fmt.Errorf("Invalid token")
+    }
+
+    claims := make(map[string]string)
+    payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return "", fmt.Errorf("Invalid token")
+    }
+    if err := json.Unmarshal(payload, &claims); err != nil {
+        return "", fmt.Errorf("Invalid token")
+    }
+
+    return claims["email"], nil
+}
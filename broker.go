@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	// TopicPriceGenerated carries the raw output of the price generators,
+	// the station receivers record it into storage.
+	TopicPriceGenerated = "prices.generated"
+	// TopicPriceRecorded carries every sequenced event of the event log.
+	TopicPriceRecorded = "prices.recorded"
+)
+
+// OverflowPolicy decides what a publisher does when a subscriber's buffer
+// is full.
+type OverflowPolicy string
+
+const (
+	OverflowBlock      OverflowPolicy = "block"
+	OverflowDropNewest OverflowPolicy = "drop_newest"
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+)
+
+func ValidOverflowPolicy(p OverflowPolicy) bool {
+	return p == OverflowBlock ||
+		p == OverflowDropNewest ||
+		p == OverflowDropOldest
+}
+
+type SubscribeOptions struct {
+	// Filter skips the events it returns false for, nil receives all.
+	Filter func(*PriceEvent) bool
+	Buffer int
+	Policy OverflowPolicy
+}
+
+// Subscription receives the events of one topic on C. C is never closed,
+// receivers stop on their own context and unsubscribe.
+type Subscription struct {
+	ID    uint64
+	Topic string
+	C     <-chan *PriceEvent
+
+	ch   chan *PriceEvent
+	opts SubscribeOptions
+	done chan struct{}
+}
+
+type TopicStatsDto struct {
+	Topic       string `json:"topic"`
+	Subscribers int    `json:"subscribers"`
+	Published   uint64 `json:"published"`
+	Delivered   uint64 `json:"delivered"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+// Broker fans price events out to the subscribers of a topic. Events are
+// shared between subscribers and must not be modified.
+type Broker interface {
+	Publish(ctx context.Context, topic string, event *PriceEvent) error
+	Subscribe(topic string, opts SubscribeOptions) (*Subscription, error)
+	Unsubscribe(*Subscription) error
+	Stats() []*TopicStatsDto
+}
+
+type memoryTopic struct {
+	subs      map[uint64]*Subscription
+	published uint64
+	delivered uint64
+	dropped   uint64
+}
+
+type MemoryBroker struct {
+	topics map[string]*memoryTopic
+	nextID uint64
+	mu     sync.Mutex
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		topics: make(map[string]*memoryTopic),
+		nextID: 1,
+	}
+}
+
+func (b *MemoryBroker) topicLocked(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memoryTopic{subs: make(map[uint64]*Subscription)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+func (b *MemoryBroker) Subscribe(topic string, opts SubscribeOptions) (*Subscription, error) {
+	if topic == "" {
+		return nil, fmt.Errorf("Topic must not be empty")
+	}
+	if opts.Policy == "" {
+		opts.Policy = OverflowDropOldest
+	}
+	if !ValidOverflowPolicy(opts.Policy) {
+		return nil, fmt.Errorf("Invalid overflow policy %q", opts.Policy)
+	}
+	if opts.Buffer < 0 {
+		return nil, fmt.Errorf("Buffer must not be negative")
+	}
+	if opts.Buffer == 0 && opts.Policy == OverflowDropOldest {
+		return nil, fmt.Errorf("Dropping the oldest event needs a buffer")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan *PriceEvent, opts.Buffer)
+	sub := &Subscription{
+		ID:    b.nextID,
+		Topic: topic,
+		C:     ch,
+		ch:    ch,
+		opts:  opts,
+		done:  make(chan struct{}),
+	}
+	b.nextID++
+	b.topicLocked(topic).subs[sub.ID] = sub
+	return sub, nil
+}
+
+func (b *MemoryBroker) Unsubscribe(sub *Subscription) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[sub.Topic]
+	if !ok || t.subs[sub.ID] == nil {
+		return fmt.Errorf("Subscription with id %d not found", sub.ID)
+	}
+	delete(t.subs, sub.ID)
+	close(sub.done)
+	return nil
+}
+
+// Publish delivers the event to every matching subscriber. Subscribers
+// with the block policy hold the publisher back until they catch up, ctx
+// ends or they unsubscribe.
+func (b *MemoryBroker) Publish(ctx context.Context, topic string, event *PriceEvent) error {
+	b.mu.Lock()
+	t := b.topicLocked(topic)
+	t.published++
+	subs := make([]*Subscription, 0, len(t.subs))
+	for _, sub := range t.subs {
+		subs = append(subs, sub)
+	}
+	b.mu.Unlock()
+
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].ID < subs[j].ID
+	})
+	for _, sub := range subs {
+		if sub.opts.Filter != nil && !sub.opts.Filter(event) {
+			continue
+		}
+		delivered, dropped, err := sub.deliver(ctx, event)
+		if err != nil {
+			return err
+		}
+
+		b.mu.Lock()
+		if delivered {
+			t.delivered++
+		}
+		if dropped {
+			t.dropped++
+		}
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// deliver reports whether the event was delivered and whether an event,
+// this or an older one, was dropped to follow the overflow policy.
+func (sub *Subscription) deliver(ctx context.Context, event *PriceEvent) (bool, bool, error) {
+	switch sub.opts.Policy {
+	case OverflowBlock:
+		select {
+		case sub.ch <- event:
+			return true, false, nil
+		case <-sub.done:
+			return false, false, nil
+		case <-ctx.Done():
+			return false, false, ctx.Err()
+		}
+	case OverflowDropNewest:
+		select {
+		case sub.ch <- event:
+			return true, false, nil
+		default:
+			return false, true, nil
+		}
+	default:
+		// Make room by discarding the oldest buffered event, the receiver
+		// may empty the buffer meanwhile so this never blocks.
+		dropped := false
+		for {
+			select {
+			case sub.ch <- event:
+				return true, dropped, nil
+			default:
+			}
+			select {
+			case <-sub.ch:
+				dropped = true
+			default:
+			}
+		}
+	}
+}
+
+func (b *MemoryBroker) Stats() []*TopicStatsDto {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := make([]*TopicStatsDto, 0, len(b.topics))
+	for name, t := range b.topics {
+		stats = append(stats, &TopicStatsDto{
+			Topic:       name,
+			Subscribers: len(t.subs),
+			Published:   t.published,
+			Delivered:   t.delivered,
+			Dropped:     t.dropped,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Topic < stats[j].Topic
+	})
+	return stats
+}
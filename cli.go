@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type apiClient struct {
+	baseUrl string
+	token   string
+	http    *http.Client
+}
+
+func newApiClient(baseUrl string, insecure bool) *apiClient {
+	return &apiClient{
+		baseUrl: strings.TrimRight(baseUrl, "/"),
+		http: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+			},
+		},
+	}
+}
+
+func (c *apiClient) login(email, password string) error {
+	body, err := json.Marshal(&LoginDto{Email: email, Password: password})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Post(c.baseUrl+"/login", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Login failed: %s", readApiError(resp.Body))
+	}
+
+	tokenDto := new(TokenDto)
+	if err := json.NewDecoder(resp.Body).Decode(tokenDto); err != nil {
+		return err
+	}
+	c.token = tokenDto.Token
+	return nil
+}
+
+func (c *apiClient) do(method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.baseUrl+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.http.Do(req)
+}
+
+func readApiError(r io.Reader) string {
+	apiErr := new(APIError)
+	raw, _ := io.ReadAll(r)
+	if err := json.Unmarshal(raw, apiErr); err == nil && apiErr.Error != "" {
+		return apiErr.Error
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// runImportCommand sends a CSV or JSON file to POST /station/import of a
+// running server and prints the per-row result.
+func runImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := fs.String("file", "", "CSV or JSON file with stations")
+	server := fs.String("server", "https://localhost:8080", "server base URL")
+	email := fs.String("email", os.Getenv("ADMIN_EMAIL"), "login email")
+	password := fs.String("password", os.Getenv("ADMIN_PASS"), "login password")
+	mode := fs.String("mode", ImportAtomic, "atomic or best_effort")
+	dryRun := fs.Bool("dry-run", false, "only validate the file")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+	if !ValidImportMode(*mode) {
+		return fmt.Errorf("Invalid import mode, expected atomic or best_effort")
+	}
+
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(*file)), ".")
+	contentType := "application/json"
+	if format == "csv" {
+		contentType = "text/csv"
+	} else if format != "json" {
+		return fmt.Errorf("Unsupported file format, expected .csv or .json")
+	}
+
+	data, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	client := newApiClient(*server, *insecure)
+	if err := client.login(*email, *password); err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("mode", *mode)
+	q.Set("format", format)
+	if *dryRun {
+		q.Set("dry_run", "true")
+	}
+
+	resp, err := client.do(http.MethodPost, "/station/import?"+q.Encode(), contentType, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	result := new(ImportResultDto)
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, result); err != nil || result.Mode == "" {
+		return fmt.Errorf("Import failed: %s", readApiError(bytes.NewReader(raw)))
+	}
+
+	fmt.Printf("mode=%s dry_run=%t total=%d valid=%d created=%d failed=%d\n",
+		result.Mode, result.DryRun, result.Total, result.Valid, result.Created, result.Failed)
+	for _, e := range result.Errors {
+		fmt.Printf("row %d: %s\n", e.Row, e.Error)
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("%d rows failed", result.Failed)
+	}
+	return nil
+}
+
+// runBrokerServerCommand runs the in-process RESP stand-in, replicas can
+// use it as BROKER_ADDR when no Redis is at hand.
+func runBrokerServerCommand(args []string) error {
+	fs := flag.NewFlagSet("broker-server", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:6379", "address to listen on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	server, err := NewRESPServer(*addr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Broker listening on %s\n", server.Addr())
+	return server.Serve()
+}
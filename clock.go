@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type RealClock struct{}
+
+func NewRealClock() *RealClock {
+	return &RealClock{}
+}
+
+func (c *RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// ScaledClock runs simulated time speed times faster than wall time,
+// starting from the moment it was created.
+type ScaledClock struct {
+	start time.Time
+	speed float64
+}
+
+func NewScaledClock(speed float64) *ScaledClock {
+	if speed <= 0 {
+		speed = 1
+	}
+	return &ScaledClock{
+		start: time.Now(),
+		speed: speed,
+	}
+}
+
+func (c *ScaledClock) Now() time.Time {
+	elapsed := time.Since(c.start)
+	return c.start.Add(time.Duration(float64(elapsed) * c.speed))
+}
+
+func (c *ScaledClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	go func() {
+		<-time.After(time.Duration(float64(d) / c.speed))
+		ch <- c.Now()
+	}()
+	return ch
+}
+
+// ManualClock only moves when Advance or Set is called, which makes it
+// possible to fast-forward a simulation without waiting.
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*clockWaiter
+}
+
+type clockWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{
+		now: start,
+	}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	deadline := c.now.Add(d)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &clockWaiter{
+		deadline: deadline,
+		ch:       ch,
+	})
+	return ch
+}
+
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.setLocked(c.now.Add(d))
+	c.mu.Unlock()
+}
+
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.setLocked(t)
+	c.mu.Unlock()
+}
+
+func (c *ManualClock) setLocked(t time.Time) {
+	if t.Before(c.now) {
+		return
+	}
+	c.now = t
+
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if !w.deadline.After(t) {
+			w.ch <- t
+			continue
+		}
+		pending = append(pending, w)
+	}
+	c.waiters = pending
+}
+
+// BlockUntil waits until at least n goroutines are sleeping on the clock,
+// so a caller can advance time knowing every generator is ready for it.
+func (c *ManualClock) BlockUntil(n int) {
+	for {
+		c.mu.Lock()
+		waiting := len(c.waiters)
+		c.mu.Unlock()
+		if waiting >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type SimConfig struct {
+	Clock    Clock
+	Seed     int64
+	Interval time.Duration
+	Replay   *ReplayConfig
+}
+
+func NewSimConfig(clock Clock, seed int64) *SimConfig {
+	return &SimConfig{
+		Clock:    clock,
+		Seed:     seed,
+		Interval: 20 * time.Second,
+	}
+}
+
+func (c *SimConfig) NewRand() *rand.Rand {
+	return rand.New(rand.NewSource(c.Seed))
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy ages are measured back from now. Raw points younger than
+// RawFor are kept as they are, older ones are merged into hourly points,
+// points older than HourlyFor into daily points, and anything older than
+// DailyFor is dropped.
+type RetentionPolicy struct {
+	RawFor    time.Duration
+	HourlyFor time.Duration
+	DailyFor  time.Duration
+	Interval  time.Duration
+}
+
+type CompactionStatsDto struct {
+	Runs            int       `json:"runs"`
+	LastRun         time.Time `json:"last_run"`
+	PointsCompacted int       `json:"points_compacted"`
+	PointsWritten   int       `json:"points_written"`
+	PointsDropped   int       `json:"points_dropped"`
+}
+
+type CompactionStatusDto struct {
+	Policy RetentionPolicyDto `json:"policy"`
+	Last   CompactionStatsDto `json:"last"`
+	Total  CompactionStatsDto `json:"total"`
+}
+
+type RetentionPolicyDto struct {
+	RawFor    string `json:"raw_for"`
+	HourlyFor string `json:"hourly_for"`
+	DailyFor  string `json:"daily_for"`
+	Interval  string `json:"interval"`
+}
+
+const (
+	ResolutionHourly = "1h"
+	ResolutionDaily  = "1d"
+)
+
+func NewRetentionPolicy(rawFor, hourlyFor, dailyFor, interval time.Duration) (*RetentionPolicy, error) {
+	if rawFor <= 0 || hourlyFor <= 0 || dailyFor <= 0 || interval <= 0 {
+		return nil, fmt.Errorf("Retention durations must be positive")
+	}
+	if hourlyFor < rawFor || dailyFor < hourlyFor {
+		return nil, fmt.Errorf("Retention durations must grow from raw to hourly to daily")
+	}
+	return &RetentionPolicy{
+		RawFor:    rawFor,
+		HourlyFor: hourlyFor,
+		DailyFor:  dailyFor,
+		Interval:  interval,
+	}, nil
+}
+
+func (p *RetentionPolicy) Dto() RetentionPolicyDto {
+	return RetentionPolicyDto{
+		RawFor:    p.RawFor.String(),
+		HourlyFor: p.HourlyFor.String(),
+		DailyFor:  p.DailyFor.String(),
+		Interval:  p.Interval.String(),
+	}
+}
+
+func (c *CompactionStatsDto) add(o *CompactionStatsDto) {
+	c.PointsCompacted += o.PointsCompacted
+	c.PointsWritten += o.PointsWritten
+	c.PointsDropped += o.PointsDropped
+}
+
+// CompactPricesHistory applies the policy to one time ordered station history.
+// Points already merged at the target resolution are merged again with
+// their sample counts as weights, so running it twice changes nothing.
+func CompactPricesHistory(hist []GasPrices, policy *RetentionPolicy, now time.Time) ([]GasPrices, *CompactionStatsDto) {
+	stats := new(CompactionStatsDto)
+	dropBefore := now.Add(-policy.DailyFor)
+	dailyBefore := now.Add(-policy.HourlyFor)
+	hourlyBefore := now.Add(-policy.RawFor)
+
+	out := make([]GasPrices, 0, len(hist))
+	var group []GasPrices
+	var groupStart time.Time
+	groupRes := ""
+
+	flush := func() {
+		if len(group) == 0 {
+			return
+		}
+		if len(group) == 1 && group[0].Resolution == groupRes {
+			out = append(out, group[0])
+		} else {
+			out = append(out, mergePrices(group, groupStart, groupRes))
+			stats.PointsCompacted += len(group)
+			stats.PointsWritten++
+		}
+		group = nil
+	}
+
+	for _, gp := range hist {
+		if gp.Time.Before(dropBefore) {
+			stats.PointsDropped++
+			continue
+		}
+
+		res := ""
+		size := time.Duration(0)
+		switch {
+		case gp.Time.Before(dailyBefore):
+			res, size = ResolutionDaily, 24*time.Hour
+		case gp.Time.Before(hourlyBefore):
+			res, size = ResolutionHourly, time.Hour
+		}
+
+		if res == "" {
+			flush()
+			out = append(out, gp)
+			continue
+		}
+
+		start := gp.Time.UTC().Truncate(size)
+		if len(group) > 0 && (res != groupRes || !start.Equal(groupStart)) {
+			flush()
+		}
+		group = append(group, gp)
+		groupStart = start
+		groupRes = res
+	}
+	flush()
+
+	return out, stats
+}
+
+func mergePrices(group []GasPrices, start time.Time, res string) GasPrices {
+	sums := make(map[GasType]float64)
+	weights := make(map[GasType]int)
+	samples := 0
+	for _, gp := range group {
+		w := gp.Samples
+		if w <= 0 {
+			w = 1
+		}
+		samples += w
+		for k, v := range gp.Prices {
+			sums[k] += v * float64(w)
+			weights[k] += w
+		}
+	}
+
+	prices := make(map[GasType]float64, len(sums))
+	for k, sum := range sums {
+		prices[k] = sum / float64(weights[k])
+	}
+	return GasPrices{
+		Prices:     prices,
+		Time:       start,
+		Resolution: res,
+		Samples:    samples,
+	}
+}
+
+type HistoryCompactor struct {
+	storage Storage
+	policy  *RetentionPolicy
+	clock   Clock
+	last    CompactionStatsDto
+	total   CompactionStatsDto
+	mu      sync.Mutex
+}
+
+func NewHistoryCompactor(storage Storage, policy *RetentionPolicy, clock Clock) *HistoryCompactor {
+	return &HistoryCompactor{
+		storage: storage,
+		policy:  policy,
+		clock:   clock,
+	}
+}
+
+func (hc *HistoryCompactor) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hc.clock.After(hc.policy.Interval):
+		}
+
+		if _, err := hc.RunOnce(); err != nil {
+			log.Println("Failed to compact price history, err: ", err)
+		}
+	}
+}
+
+func (hc *HistoryCompactor) RunOnce() (*CompactionStatsDto, error) {
+	stats, err := hc.storage.CompactHistory(hc.policy)
+	if err != nil {
+		return nil, err
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	stats.Runs = 1
+	stats.LastRun = hc.clock.Now()
+	hc.last = *stats
+	hc.total.add(stats)
+	hc.total.Runs++
+	hc.total.LastRun = stats.LastRun
+	return stats, nil
+}
+
+func (hc *HistoryCompactor) Status() *CompactionStatusDto {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	return &CompactionStatusDto{
+		Policy: hc.policy.Dto(),
+		Last:   hc.last,
+		Total:  hc.total,
+	}
+}
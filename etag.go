@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// StatusError makes wrapApiHandleFunc answer with Status instead of 400.
+type StatusError struct {
+	Status int
+	Err    error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+func NewStatusError(status int, err error) *StatusError {
+	return &StatusError{
+		Status: status,
+		Err:    err,
+	}
+}
+
+func userETag(u *User) string {
+	return fmt.Sprintf("\"%d\"", u.Version)
+}
+
+// stationETag includes the price version and the open status next to the
+// version since responses change with them without the station being
+// modified. Only the version is compared for If-Match.
+func stationETag(st *StationView) string {
+	open := "closed"
+	if st.Open {
+		open = "open"
+	}
+	return fmt.Sprintf("\"%d-%d-%s\"", st.Version, st.PriceVersion, open)
+}
+
+// etagVersion returns the version a strong ETag was built from.
+func etagVersion(etag string) (uint64, error) {
+	tag := strings.Trim(strings.TrimSpace(etag), "\"")
+	tag, _, _ = strings.Cut(tag, "-")
+	version, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid ETag %s", etag)
+	}
+	return version, nil
+}
+
+// ifMatchVersion returns the version If-Match requires, or 0 when any
+// version is accepted. With REQUIRE_IF_MATCH=true the header is mandatory.
+func ifMatchVersion(r *http.Request) (uint64, error) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	if ifMatch == "" {
+		if os.Getenv("REQUIRE_IF_MATCH") == "true" {
+			return 0, NewStatusError(http.StatusPreconditionRequired, fmt.Errorf("If-Match header is required"))
+		}
+		return 0, nil
+	}
+	if ifMatch == "*" {
+		return 0, nil
+	}
+	if strings.Contains(ifMatch, ",") {
+		return 0, fmt.Errorf("If-Match must hold a single ETag")
+	}
+	// If-Match uses the strong comparison, a weak ETag never matches.
+	if strings.HasPrefix(ifMatch, "W/") {
+		return 0, NewStatusError(http.StatusPreconditionFailed, fmt.Errorf("If-Match does not accept weak ETag %s", ifMatch))
+	}
+	return etagVersion(ifMatch)
+}
+
+// writeNotModified answers 304 when If-None-Match lists etag.
+func writeNotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// versionError turns a storage version mismatch into 412.
+func versionError(err error) error {
+	if errors.Is(err, ErrVersionMismatch) {
+		return NewStatusError(http.StatusPreconditionFailed, err)
+	}
+	return err
+}
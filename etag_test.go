@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStationETagIgnoresPriceTicksForIfMatch(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, _ := newTestStorage(t, NewSimConfig(clock, 7))
+	st, err := storage.CreateStation(testStationDto("Zagreb", 45.8, 15.9))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := storage.GetStationByID(st.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.RecordPrice(st.ID, GasPrices{Prices: map[GasType]float64{"diesel": 1.40, "gasoline": 1.50}}); err != nil {
+		t.Fatal(err)
+	}
+	after, err := storage.GetStationByID(st.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.Version != before.Version {
+		t.Fatalf("Recorded price changed the version from %d to %d", before.Version, after.Version)
+	}
+	if stationETag(after) == stationETag(before) {
+		t.Fatal("Recorded price did not change the ETag")
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "/station/1", nil)
+	r.Header.Set("If-Match", stationETag(before))
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := storage.UpdateStation(st.ID, version, testStationDto("Zagreb 2", 45.8, 15.9)); err != nil {
+		t.Fatalf("Update with the ETag read before a price tick failed: %v", err)
+	}
+}
+
+func TestIfMatchRejectsWeakETag(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPut, "/station/1", nil)
+	r.Header.Set("If-Match", `W/"3-0-open"`)
+	_, err := ifMatchVersion(r)
+	statusErr, ok := err.(*StatusError)
+	if !ok || statusErr.Status != http.StatusPreconditionFailed {
+		t.Fatalf("Weak If-Match got %v, want 412", err)
+	}
+
+	r.Header.Set("If-Match", `"3-0-open"`)
+	if version, err := ifMatchVersion(r); err != nil || version != 3 {
+		t.Fatalf("Strong If-Match got version %d, %v", version, err)
+	}
+}
+
+// racingStorage runs meanwhile right after a station is read, like a
+// request that lands between the read and the write of another one.
+type racingStorage struct {
+	*RAMStorage
+	meanwhile func()
+}
+
+func (s *racingStorage) GetStationByID(id uint64) (*StationView, error) {
+	station, err := s.RAMStorage.GetStationByID(id)
+	if s.meanwhile != nil {
+		s.meanwhile()
+		s.meanwhile = nil
+	}
+	return station, err
+}
+
+func patchStation(server *APIServer, id uint64, patch string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPatch, "/station/"+strconv.FormatUint(id, 10), strings.NewReader(patch))
+	r.SetPathValue("id", strconv.FormatUint(id, 10))
+	w := httptest.NewRecorder()
+	wrapApiHandleFunc(server.handlePatchStation)(w, r)
+	return w
+}
+
+func TestPatchStationKeepsPricesRecordedMeanwhile(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	ram, _ := newTestStorage(t, NewSimConfig(clock, 7))
+	st, err := ram.CreateStation(testStationDto("Zagreb", 45.8, 15.9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &racingStorage{RAMStorage: ram}
+	server := &APIServer{storage: storage, audit: NewRAMAuditStore(clock)}
+
+	recorded := map[GasType]float64{"diesel": 1.40, "gasoline": 1.50}
+	storage.meanwhile = func() {
+		if err := ram.RecordPrice(st.ID, GasPrices{Prices: recorded}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w := patchStation(server, st.ID, `{"name": "Zagreb 2"}`); w.Code != http.StatusOK {
+		t.Fatalf("Patch failed with %d: %s", w.Code, w.Body)
+	}
+
+	after, err := ram.GetStationByID(st.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Name != "Zagreb 2" || !pricesEqual(after.CurrentPrice.Prices, recorded) {
+		t.Fatalf("Patch reverted the recorded prices: %+v", after.CurrentPrice)
+	}
+}
+
+func TestPatchStationWithoutIfMatchFailsOnConcurrentWrite(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	ram, _ := newTestStorage(t, NewSimConfig(clock, 7))
+	st, err := ram.CreateStation(testStationDto("Zagreb", 45.8, 15.9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &racingStorage{RAMStorage: ram}
+	server := &APIServer{storage: storage, audit: NewRAMAuditStore(clock)}
+
+	storage.meanwhile = func() {
+		if _, _, err := ram.UpdateStation(st.ID, 0, testStationDto("Zagreb Centar", 45.8, 15.9)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w := patchStation(server, st.ID, `{"address": "Ilica 2"}`); w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Patch over a concurrent write got %d: %s", w.Code, w.Body)
+	}
+
+	after, err := ram.GetStationByID(st.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Name != "Zagreb Centar" {
+		t.Fatalf("Concurrent write was overwritten: %+v", after.Station)
+	}
+}
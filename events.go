@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrEventsEvicted means events after the requested sequence number
+	// were dropped from the log, the client has to start over.
+	ErrEventsEvicted = errors.New("Events are no longer available")
+	// ErrEventsAhead means the requested sequence number was never issued.
+	ErrEventsAhead = errors.New("Event does not exist yet")
+)
+
+// PriceEvent carries a price of a station. ExternalID identifies the
+// station across replicas since station ids are generated per process.
+// Shared marks prices that originate on this instance, the other replicas
+// still have to record them.
+type PriceEvent struct {
+	Seq        uint64              `json:"seq"`
+	Time       time.Time           `json:"time"`
+	StationID  uint64              `json:"station_id"`
+	ExternalID string              `json:"external_id,omitempty"`
+	Prices     map[GasType]float64 `json:"prices"`
+	Capped     []GasType           `json:"capped,omitempty"`
+	Shared     bool                `json:"-"`
+}
+
+// GasPrices returns a copy of the prices carried by the event.
+func (e *PriceEvent) GasPrices() GasPrices {
+	return GasPrices{
+		Prices: e.Prices,
+		Time:   e.Time,
+		Capped: e.Capped,
+	}.Copy()
+}
+
+type EventsPageDto struct {
+	Epoch     string        `json:"epoch"`
+	Events    []*PriceEvent `json:"events"`
+	LastSeq   uint64        `json:"last_seq"`
+	OldestSeq uint64        `json:"oldest_seq"`
+}
+
+// EventLog is the sequenced log of price changes of this process. It keeps
+// the newest size events, clients resume by asking for the events after
+// the last sequence number they have seen. Sequence numbers only mean
+// something within one epoch, a new one starts with every process so a
+// cursor from a restarted or other replica is never taken for a local one.
+type EventLog struct {
+	events  []*PriceEvent
+	size    int
+	epoch   string
+	lastSeq uint64
+	changed chan struct{}
+	mu      sync.Mutex
+}
+
+func NewEventLog(size int) *EventLog {
+	return &EventLog{
+		events:  make([]*PriceEvent, 0),
+		size:    size,
+		epoch:   strconv.FormatUint(rand.Uint64(), 36),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *EventLog) Epoch() string {
+	return l.epoch
+}
+
+// Append records a price the station received, from its generator or from
+// another replica.
+func (l *EventLog) Append(stationID uint64, price GasPrices) uint64 {
+	return l.append(&PriceEvent{StationID: stationID}, price)
+}
+
+// AppendShared records a price changed on this instance, it is shared with
+// the other replicas under the external id of the station.
+func (l *EventLog) AppendShared(stationID uint64, externalID string, price GasPrices) uint64 {
+	return l.append(&PriceEvent{StationID: stationID, ExternalID: externalID, Shared: true}, price)
+}
+
+func (l *EventLog) append(event *PriceEvent, price GasPrices) uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cp := price.Copy()
+	l.lastSeq++
+	event.Seq = l.lastSeq
+	event.Time = cp.Time
+	event.Prices = cp.Prices
+	event.Capped = cp.Capped
+	l.events = append(l.events, event)
+	if len(l.events) > l.size {
+		l.events = append(l.events[:0], l.events[len(l.events)-l.size:]...)
+	}
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return l.lastSeq
+}
+
+// After returns up to limit events with a sequence number above seq,
+// optionally only of one station. It fails when events after seq have
+// already been dropped from the log, since the client would miss them,
+// and when seq is past the last event.
+func (l *EventLog) After(seq uint64, stationID uint64, limit int) (*EventsPageDto, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Checked first, seq+1 below must not overflow.
+	if seq > l.lastSeq {
+		return nil, fmt.Errorf("%w, %d is past the last event %d", ErrEventsAhead, seq, l.lastSeq)
+	}
+	oldest := l.oldestSeqLocked()
+	if seq+1 < oldest {
+		return nil, fmt.Errorf("%w, oldest after %d is %d", ErrEventsEvicted, seq, oldest)
+	}
+
+	page := &EventsPageDto{
+		Epoch:     l.epoch,
+		Events:    make([]*PriceEvent, 0),
+		LastSeq:   seq,
+		OldestSeq: oldest,
+	}
+	for _, e := range l.events[seq+1-oldest:] {
+		if len(page.Events) == limit {
+			break
+		}
+		page.LastSeq = e.Seq
+		if stationID == 0 || e.StationID == stationID {
+			page.Events = append(page.Events, e)
+		}
+	}
+	return page, nil
+}
+
+func (l *EventLog) oldestSeqLocked() uint64 {
+	if len(l.events) > 0 {
+		return l.events[0].Seq
+	}
+	return l.lastSeq + 1
+}
+
+// Wait blocks until an event after seq is appended or ctx is done.
+func (l *EventLog) Wait(ctx context.Context, seq uint64) {
+	l.mu.Lock()
+	changed := l.changed
+	ready := l.lastSeq > seq
+	l.mu.Unlock()
+
+	if ready {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-changed:
+	}
+}
+
+func (l *EventLog) LastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lastSeq
+}
+
+// Forward publishes every event appended from now on to TopicPriceRecorded
+// until ctx ends. It runs apart from storage so slow subscribers never hold
+// the storage lock.
+func (l *EventLog) Forward(ctx context.Context, broker Broker) {
+	seq := l.LastSeq()
+	for ctx.Err() == nil {
+		page, err := l.After(seq, 0, 1000)
+		if err != nil {
+			log.Printf("Event forwarding fell behind: %v", err)
+			l.mu.Lock()
+			seq = l.oldestSeqLocked() - 1
+			l.mu.Unlock()
+			continue
+		}
+		for _, e := range page.Events {
+			if err := broker.Publish(ctx, TopicPriceRecorded, e); err != nil {
+				return
+			}
+		}
+		seq = page.LastSeq
+		l.Wait(ctx, seq)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetEventsStatusForUnavailableSeq(t *testing.T) {
+	events := NewEventLog(2)
+	for i := 0; i < 5; i++ {
+		events.Append(1, GasPrices{Prices: map[GasType]float64{"diesel": 1.4}, Time: time.Now()})
+	}
+	server := &APIServer{events: events}
+
+	tests := []struct {
+		after string
+		want  int
+	}{
+		{"4", http.StatusOK},
+		{"1", http.StatusGone},
+		{"9", http.StatusBadRequest},
+		{"18446744073709551615", http.StatusBadRequest},
+		{events.Epoch() + ":4", http.StatusOK},
+		{"other:4", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/events?after="+tt.after, nil)
+		wrapApiHandleFunc(server.handleGetEvents)(w, r)
+		if w.Code != tt.want {
+			t.Errorf("after=%s got %d, want %d: %s", tt.after, w.Code, tt.want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ContentTypeGeoJSON = "application/geo+json"
+	ContentTypeKML     = "application/vnd.google-earth.kml+xml"
+)
+
+type GeoJSONFeatureCollection struct {
+	Type     string            `json:"type"`
+	Features []*GeoJSONFeature `json:"features"`
+}
+
+type GeoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONPoint           `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type kmlDocument struct {
+	XMLName  xml.Name `xml:"kml"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Document kmlBody  `xml:"Document"`
+}
+
+type kmlBody struct {
+	Name       string          `xml:"name"`
+	Placemarks []*kmlPlacemark `xml:"Placemark"`
+}
+
+type kmlPlacemark struct {
+	ID           string          `xml:"id,attr"`
+	Name         string          `xml:"name"`
+	Address      string          `xml:"address,omitempty"`
+	Description  string          `xml:"description,omitempty"`
+	ExtendedData kmlExtendedData `xml:"ExtendedData"`
+	Point        kmlPoint        `xml:"Point"`
+}
+
+type kmlExtendedData struct {
+	Data []kmlData `xml:"Data"`
+}
+
+type kmlData struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value"`
+}
+
+type kmlPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+func NewGeoJSONFeatureCollection(stations []*StationView) *GeoJSONFeatureCollection {
+	features := make([]*GeoJSONFeature, 0, len(stations))
+	for _, st := range stations {
+		features = append(features, &GeoJSONFeature{
+			Type: "Feature",
+			Geometry: GeoJSONPoint{
+				Type:        "Point",
+				Coordinates: [2]float64{st.Location.Longitude, st.Location.Latitude},
+			},
+			Properties: map[string]interface{}{
+				"id":             st.ID,
+				"brand_id":       st.BrandID,
+				"name":           st.Name,
+				"address":        st.Address,
+				"supported_fuel": st.SupportedFuel,
+				"regions":        st.Regions,
+				"amenities":      st.Amenities,
+				"prices":         st.CurrentPrice.Prices,
+				"price_time":     st.CurrentPrice.Time,
+			},
+		})
+	}
+	return &GeoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: features,
+	}
+}
+
+func NewKMLDocument(stations []*StationView) ([]byte, error) {
+	placemarks := make([]*kmlPlacemark, 0, len(stations))
+	for _, st := range stations {
+		fuels := make([]string, len(st.SupportedFuel))
+		for i, f := range st.SupportedFuel {
+			fuels[i] = string(f)
+		}
+
+		data := []kmlData{
+			{Name: "id", Value: fmt.Sprint(st.ID)},
+			{Name: "supported_fuel", Value: strings.Join(fuels, ",")},
+			{Name: "regions", Value: strings.Join(st.Regions, ",")},
+			{Name: "price_time", Value: st.CurrentPrice.Time.Format(time.RFC3339)},
+		}
+		prices := make([]string, 0, len(st.CurrentPrice.Prices))
+		for _, gt := range sortedGasTypes(st.CurrentPrice.Prices) {
+			p := fmt.Sprintf("%.3f", st.CurrentPrice.Prices[gt])
+			data = append(data, kmlData{Name: "price_" + string(gt), Value: p})
+			prices = append(prices, string(gt)+": "+p)
+		}
+
+		placemarks = append(placemarks, &kmlPlacemark{
+			ID:           fmt.Sprintf("station-%d", st.ID),
+			Name:         st.Name,
+			Address:      st.Address,
+			Description:  strings.Join(prices, "\n"),
+			ExtendedData: kmlExtendedData{Data: data},
+			Point: kmlPoint{
+				Coordinates: fmt.Sprintf("%f,%f,0", st.Location.Longitude, st.Location.Latitude),
+			},
+		})
+	}
+
+	doc := &kmlDocument{
+		Xmlns: "http://www.opengis.net/kml/2.2",
+		Document: kmlBody{
+			Name:       "Stations",
+			Placemarks: placemarks,
+		},
+	}
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// negotiateStationFormat prefers an explicit format query parameter over
+// the Accept header and falls back to plain JSON.
+func negotiateStationFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+	case "json", "geojson", "kml":
+		return f, nil
+	default:
+		return "", fmt.Errorf("Invalid format, expected json, geojson or kml")
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, ContentTypeGeoJSON):
+		return "geojson", nil
+	case strings.Contains(accept, ContentTypeKML):
+		return "kml", nil
+	}
+	return "json", nil
+}
+
+func rawWriter(w http.ResponseWriter, status int, contentType string, body []byte) error {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	_, err := w.Write(body)
+	return err
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BoundingBox struct {
+	MinLatitude  float64 `json:"min_latitude"`
+	MinLongitude float64 `json:"min_longitude"`
+	MaxLatitude  float64 `json:"max_latitude"`
+	MaxLongitude float64 `json:"max_longitude"`
+}
+
+// StationFilter narrows a set of stations, zero fields do not filter.
+type StationFilter struct {
+	BBox      *BoundingBox
+	Center    *Location
+	RadiusKm  float64
+	Region    string
+	BrandID   uint64
+	OpenNow   bool
+	OpenAt    time.Time
+	Amenities []Amenity
+	Connector string
+}
+
+func (b *BoundingBox) Contains(loc *Location) bool {
+	return loc.Latitude >= b.MinLatitude &&
+		loc.Latitude <= b.MaxLatitude &&
+		loc.Longitude >= b.MinLongitude &&
+		loc.Longitude <= b.MaxLongitude
+}
+
+func (f *StationFilter) Matches(st *Station) bool {
+	if f == nil {
+		return true
+	}
+	if f.BBox != nil && !f.BBox.Contains(&st.Location) {
+		return false
+	}
+	if f.Center != nil && DistanceKm(f.Center, &st.Location) > f.RadiusKm {
+		return false
+	}
+	if f.Region != "" {
+		found := false
+		for _, r := range st.Regions {
+			if r == f.Region {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.BrandID != 0 && st.BrandID != f.BrandID {
+		return false
+	}
+	if !f.OpenAt.IsZero() && !st.Hours.OpenAt(f.OpenAt) {
+		return false
+	}
+	for _, a := range f.Amenities {
+		if !hasAmenity(st.Amenities, a) {
+			return false
+		}
+	}
+	if f.Connector != "" && !hasConnector(st.EVConnectors, f.Connector) {
+		return false
+	}
+	return true
+}
+
+// ParseStationFilter reads bbox=minLat,minLon,maxLat,maxLon,
+// lat=..&lon=..&radius_km=.., region=.., brand=.., open_now=true,
+// open_at=<RFC3339>, amenities=a,b and connector=.. from the query
+// string. open_now is resolved against the storage clock, see
+// RAMStorage.resolveFilterLocked.
+func ParseStationFilter(q url.Values) (*StationFilter, error) {
+	filter := new(StationFilter)
+
+	if v := q.Get("bbox"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("Invalid bbox, expected minLat,minLon,maxLat,maxLon")
+		}
+		nums := make([]float64, 4)
+		for i, p := range parts {
+			n, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid bbox, expected minLat,minLon,maxLat,maxLon")
+			}
+			nums[i] = n
+		}
+		if nums[0] > nums[2] || nums[1] > nums[3] {
+			return nil, fmt.Errorf("Invalid bbox, min values must not exceed max values")
+		}
+		filter.BBox = &BoundingBox{
+			MinLatitude:  nums[0],
+			MinLongitude: nums[1],
+			MaxLatitude:  nums[2],
+			MaxLongitude: nums[3],
+		}
+	}
+
+	if q.Get("lat") != "" || q.Get("lon") != "" || q.Get("radius_km") != "" {
+		lat, errLat := strconv.ParseFloat(q.Get("lat"), 64)
+		lon, errLon := strconv.ParseFloat(q.Get("lon"), 64)
+		radius, errRadius := strconv.ParseFloat(q.Get("radius_km"), 64)
+		if errLat != nil || errLon != nil || errRadius != nil || radius <= 0 {
+			return nil, fmt.Errorf("Invalid radius filter, lat, lon and positive radius_km are required")
+		}
+		filter.Center = &Location{
+			Latitude:  lat,
+			Longitude: lon,
+		}
+		filter.RadiusKm = radius
+	}
+
+	filter.Region = q.Get("region")
+
+	if v := q.Get("brand"); v != "" {
+		brandID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid brand id")
+		}
+		filter.BrandID = brandID
+	}
+
+	if v := q.Get("open_now"); v != "" {
+		openNow, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid open_now, expected true or false")
+		}
+		filter.OpenNow = openNow
+	}
+	if v := q.Get("open_at"); v != "" {
+		openAt, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid open_at, expected RFC3339 time")
+		}
+		filter.OpenAt = openAt
+	}
+
+	if v := q.Get("amenities"); v != "" {
+		filter.Amenities = ParseAmenities(v, ",")
+		for _, a := range filter.Amenities {
+			if !ValidAmenity(a) {
+				return nil, fmt.Errorf("Invalid amenity %q", a)
+			}
+		}
+	}
+	if v := q.Get("connector"); v != "" {
+		if !ValidConnectorType(v) {
+			return nil, fmt.Errorf("Invalid connector type %q, expected type2, ccs, chademo or tesla", v)
+		}
+		filter.Connector = v
+	}
+
+	return filter, nil
+}
@@ -1,50 +1,95 @@
 package main
 
 import (
+	"context"
+	"log"
 	"math"
 	"math/rand"
+	"sort"
 	"time"
 )
 
 type PriceSource interface {
 	GetPrice() GasPrices 
+	GetRegions() []string
+	GetPriceCaps() []*PriceCap
+}
+
+// PriceStore is the part of the storage the generators are allowed to
+// touch, every read returns a copy and every write happens under the
+// storage lock.
+type PriceStore interface {
+	GetCurrentPrice(uint64) (GasPrices, error)
+	GetStationRegions(uint64) ([]string, error)
+	GetActivePriceCaps() ([]*PriceCap, error)
+	RecordPrice(uint64, GasPrices) error
 }
 
 type StationPriceSource struct {
-	Station *Station
+	StationID uint64
+	store     PriceStore
 }
 
-func NewStationPriceSource(s *Station) *StationPriceSource {
+func NewStationPriceSource(id uint64, store PriceStore) *StationPriceSource {
 	return &StationPriceSource{
-		Station: s,
+		StationID: id,
+		store:     store,
 	}
 }
 
 func (s *StationPriceSource) GetPrice() GasPrices {
-	return s.Station.CurrentPrice
+	price, err := s.store.GetCurrentPrice(s.StationID)
+	if err != nil {
+		return GasPrices{}
+	}
+	return price
+}
+
+func (s *StationPriceSource) GetPriceCaps() []*PriceCap {
+	caps, err := s.store.GetActivePriceCaps()
+	if err != nil {
+		return nil
+	}
+	return caps
+}
+
+func (s *StationPriceSource) GetRegions() []string {
+	regions, err := s.store.GetStationRegions(s.StationID)
+	if err != nil {
+		return nil
+	}
+	return regions
+}
+
+// PricePublisher publishes the prices generated for one station.
+type PricePublisher interface {
+    PublishPrice(ctx context.Context, price GasPrices) error
 }
 
 type PriceModifier interface {
 	ModifyPrice(float64) float64
-    SendPrice(ch GasPrices)
+    SendPrice(ctx context.Context, pub PricePublisher)
 }
 
 type MCPriceGen struct {
 	interval          time.Duration
-	initalPriceSource *StationPriceSource
+	initalPriceSource PriceSource
+	clock             Clock
+	rnd               *rand.Rand
+	market            *Market
 }
 
-func NewMCPriceGen(interval time.Duration, ps *StationPriceSource) *MCPriceGen {
+func NewMCPriceGen(interval time.Duration, ps PriceSource, clock Clock, rnd *rand.Rand, market *Market) *MCPriceGen {
 	return &MCPriceGen{
 		interval:          interval,
 		initalPriceSource: ps,
+		clock:             clock,
+		rnd:               rnd,
+		market:            market,
 	}
 }
 
 func (mc *MCPriceGen) ModifyPrice(num float64) float64 {
-    src := rand.NewSource(time.Now().UnixNano())
-	rnd := rand.New(src)
-
 	mu := 0.05
 	sigma := 0.2
 	T := 1.0
@@ -53,46 +98,96 @@ func (mc *MCPriceGen) ModifyPrice(num float64) float64 {
 	numSteps := int(T / dt)
 	price := num
 	for i := 0; i < numSteps; i++ {
-		dW := math.Sqrt(dt) * rnd.NormFloat64()
+		dW := math.Sqrt(dt) * mc.rnd.NormFloat64()
 		price *= math.Exp((mu - 0.5 * sigma * sigma) * dt + sigma * dW)
 	}
     
     return price
 }
 
-func (mc *MCPriceGen) SendPrice(ch chan GasPrices) {
+func (mc *MCPriceGen) SendPrice(ctx context.Context, pub PricePublisher) {
 	for {
-        time.Sleep(mc.interval)
+        select {
+        case <-ctx.Done():
+            return
+        case <-mc.clock.After(mc.interval):
+        }
 		prevPrice := mc.initalPriceSource.GetPrice()
+        regions := mc.initalPriceSource.GetRegions()
         newPrice := GasPrices{
             Prices: make(map[GasType]float64),
-            Time: time.Now(),
+            Time: mc.clock.Now(),
+        }
+        for _, k := range sortedGasTypes(prevPrice.Prices) {
+            price := mc.ModifyPrice(prevPrice.Prices[k])
+            price *= mc.marketMove(k, regions, prevPrice.Time, newPrice.Time)
+            newPrice.Prices[k] = price
         }
-        for k, v := range prevPrice.Prices {
-            newPrice.Prices[k] = mc.ModifyPrice(v)
+        ClampPriceCaps(mc.initalPriceSource.GetPriceCaps(), &newPrice, regions)
+        if err := pub.PublishPrice(ctx, newPrice); err != nil {
+            return
         }
-        ch <- newPrice
 	}
 }
 
+// The station follows the shared market by the same ratio the market moved
+// since the previous price, on top of its own noise.
+func (mc *MCPriceGen) marketMove(gt GasType, regions []string, from, to time.Time) float64 {
+    if mc.market == nil {
+        return 1
+    }
+    prev := mc.market.Factor(gt, regions, from)
+    if prev == 0 {
+        return 1
+    }
+    return mc.market.Factor(gt, regions, to) / prev
+}
+
+// Map iteration order is random, so prices are modified in a fixed order
+// to keep the random number stream reproducible for a given seed.
+func sortedGasTypes(prices map[GasType]float64) []GasType {
+    keys := make([]GasType, 0, len(prices))
+    for k := range prices {
+        keys = append(keys, k)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        return keys[i] < keys[j]
+    })
+    return keys
+}
+
 type PriceReceiver interface {
-    ReceivePrice(ch chan map[GasType]float64)
+    ReceivePrice(ctx context.Context, sub *Subscription)
 }
 
 type StationPriceReceiver struct {
-    Station *Station
+    StationID uint64
+    store     PriceStore
+    clock     Clock
 }
 
-func NewStationPriceReceiver(s *Station) *StationPriceReceiver {
+func NewStationPriceReceiver(id uint64, store PriceStore, clock Clock) *StationPriceReceiver {
     return &StationPriceReceiver{
-        Station: s,
+        StationID: id,
+        store:     store,
+        clock:     clock,
     }
 }
 
-func (s *StationPriceReceiver) ReceivePrice(ch chan GasPrices) {
+func (s *StationPriceReceiver) ReceivePrice(ctx context.Context, sub *Subscription) {
     for {
-        newPrice := <-ch
-        s.Station.PricesHistory = append(s.Station.PricesHistory, s.Station.CurrentPrice)
-        s.Station.CurrentPrice = newPrice
+        var event *PriceEvent
+        select {
+        case <-ctx.Done():
+            return
+        case event = <-sub.C:
+        }
+        newPrice := event.GasPrices()
+        if newPrice.Time.IsZero() {
+            newPrice.Time = s.clock.Now()
+        }
+        if err := s.store.RecordPrice(s.StationID, newPrice); err != nil {
+            log.Printf("Failed to record price for station %d: %v", s.StationID, err)
+        }
     }
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestStorage(t *testing.T, sim *SimConfig) (*RAMStorage, *GeneratorSupervisor) {
+	t.Helper()
+	supervisor := NewGeneratorSupervisor(sim.Clock, NewMemoryBroker())
+	t.Cleanup(func() {
+		supervisor.Shutdown(context.Background())
+	})
+	return NewRAMStorage(sim, supervisor, NewMarket(sim), NewEventLog(1000)), supervisor
+}
+
+func testStationDto(name string, lat, lon float64) *StationDto {
+	return &StationDto{
+		Name:          name,
+		Address:       name + " 1",
+		SupportedFuel: []GasType{"diesel", "gasoline"},
+		Location:      Location{Latitude: lat, Longitude: lon},
+		CurrentPrice:  map[GasType]float64{"diesel": 1.45, "gasoline": 1.52},
+	}
+}
+
+// runSimulation advances a manual clock one interval at a time and waits
+// for every station to record the tick before the next one.
+func runSimulation(t *testing.T, seed int64, ticks int) map[string][]GasPrices {
+	start := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	sim := NewSimConfig(clock, seed)
+	storage, _ := newTestStorage(t, sim)
+
+	stations := make([]*Station, 0)
+	for i, name := range []string{"Zagreb", "Split", "Rijeka"} {
+		st, err := storage.CreateStation(testStationDto(name, 45+float64(i), 15+float64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stations = append(stations, st)
+	}
+
+	for tick := 1; tick <= ticks; tick++ {
+		clock.BlockUntil(len(stations))
+		clock.Advance(sim.Interval)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for _, st := range stations {
+			for {
+				got, err := storage.GetStationByID(st.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got.PricesHistory) >= tick {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("Station %s did not record tick %d", st.Name, tick)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	histories := make(map[string][]GasPrices)
+	for _, st := range stations {
+		got, err := storage.GetStationByID(st.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		histories[st.Name] = append(got.PricesHistory, got.CurrentPrice)
+	}
+	return histories
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	first := runSimulation(t, 42, 10)
+	second := runSimulation(t, 42, 10)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("Same seed produced different histories:\n%v\n%v", first, second)
+	}
+
+	other := runSimulation(t, 43, 10)
+	if reflect.DeepEqual(first, other) {
+		t.Fatal("Different seeds produced identical histories")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type GeoJSONGeometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// Polygon rings hold [longitude, latitude] pairs as in GeoJSON, the first
+// ring is the outer boundary and the rest are holes.
+type Polygon [][][2]float64
+
+type geoJSONFeature struct {
+	Type     string           `json:"type"`
+	Geometry *GeoJSONGeometry `json:"geometry"`
+}
+
+// ParseGeoJSONPolygons accepts a Polygon or MultiPolygon geometry, or a
+// Feature wrapping one.
+func ParseGeoJSONPolygons(raw json.RawMessage) ([]Polygon, error) {
+	geom := new(GeoJSONGeometry)
+	if err := json.Unmarshal(raw, geom); err != nil {
+		return nil, fmt.Errorf("Invalid GeoJSON: %v", err)
+	}
+
+	if geom.Type == "Feature" {
+		feature := new(geoJSONFeature)
+		if err := json.Unmarshal(raw, feature); err != nil || feature.Geometry == nil {
+			return nil, fmt.Errorf("Invalid GeoJSON feature")
+		}
+		geom = feature.Geometry
+	}
+
+	var polygons []Polygon
+	switch geom.Type {
+	case "Polygon":
+		var p Polygon
+		if err := json.Unmarshal(geom.Coordinates, &p); err != nil {
+			return nil, fmt.Errorf("Invalid Polygon coordinates")
+		}
+		polygons = []Polygon{p}
+	case "MultiPolygon":
+		if err := json.Unmarshal(geom.Coordinates, &polygons); err != nil {
+			return nil, fmt.Errorf("Invalid MultiPolygon coordinates")
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported geometry type %q, expected Polygon or MultiPolygon", geom.Type)
+	}
+
+	if len(polygons) == 0 {
+		return nil, fmt.Errorf("Geometry has no polygons")
+	}
+	for _, p := range polygons {
+		if len(p) == 0 {
+			return nil, fmt.Errorf("Polygon has no rings")
+		}
+		for _, ring := range p {
+			if len(ring) < 4 {
+				return nil, fmt.Errorf("Polygon ring needs at least 4 positions")
+			}
+			if ring[0] != ring[len(ring)-1] {
+				return nil, fmt.Errorf("Polygon ring must be closed")
+			}
+		}
+	}
+	return polygons, nil
+}
+
+func (p Polygon) Contains(loc *Location) bool {
+	if len(p) == 0 || !ringContains(p[0], loc) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if ringContains(hole, loc) {
+			return false
+		}
+	}
+	return true
+}
+
+// ringContains casts a ray from the point towards positive longitude and
+// counts how many ring edges it crosses, an odd count means inside.
+func ringContains(ring [][2]float64, loc *Location) bool {
+	x := loc.Longitude
+	y := loc.Latitude
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > y) != (yj > y) && x < (xj-xi)*(y-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func PolygonsContain(polygons []Polygon, loc *Location) bool {
+	for _, p := range polygons {
+		if p.Contains(loc) {
+			return true
+		}
+	}
+	return false
+}
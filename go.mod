@@ -2,4 +2,4 @@ module gas_prices
 
 go 1.22.1
 
-require golang.org/x/crypto v0.24.0 // indirect
+require golang.org/x/crypto v0.24.0
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// historyRange returns the part of a time ordered history that falls in
+// [from, to], a zero bound leaves that side open.
+func historyRange(hist []GasPrices, from, to time.Time) []GasPrices {
+	start := 0
+	if !from.IsZero() {
+		start = sort.Search(len(hist), func(i int) bool {
+			return !hist[i].Time.Before(from)
+		})
+	}
+	end := len(hist)
+	if !to.IsZero() {
+		end = sort.Search(len(hist), func(i int) bool {
+			return hist[i].Time.After(to)
+		})
+	}
+	if start > end {
+		return nil
+	}
+	return hist[start:end]
+}
+
+func inTimeRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || !t.After(to))
+}
+
+// AggregatePricePoints groups ordered points into buckets aligned to
+// multiples of size since the zero time, so 24h buckets start at UTC
+// midnight.
+func AggregatePricePoints(points []PricePointDto, size time.Duration) []PriceBucketDto {
+	buckets := make([]PriceBucketDto, 0)
+	if size <= 0 {
+		return buckets
+	}
+
+	sum := 0.0
+	for _, p := range points {
+		start := p.Time.UTC().Truncate(size)
+		if len(buckets) == 0 || !buckets[len(buckets)-1].Start.Equal(start) {
+			if len(buckets) > 0 {
+				last := &buckets[len(buckets)-1]
+				last.Avg = sum / float64(last.Count)
+			}
+			buckets = append(buckets, PriceBucketDto{
+				Start: start,
+				End:   start.Add(size),
+				Open:  p.Price,
+				High:  p.Price,
+				Low:   p.Price,
+			})
+			sum = 0
+		}
+
+		b := &buckets[len(buckets)-1]
+		if p.Price > b.High {
+			b.High = p.Price
+		}
+		if p.Price < b.Low {
+			b.Low = p.Price
+		}
+		b.Close = p.Price
+		b.Count++
+		sum += p.Price
+	}
+	if len(buckets) > 0 {
+		last := &buckets[len(buckets)-1]
+		last.Avg = sum / float64(last.Count)
+	}
+
+	return buckets
+}
+
+// ParseDayDuration accepts Go durations ("15m", "1h") and whole days ("1d").
+func ParseDayDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("Invalid duration %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid duration %s", s)
+	}
+	return d, nil
+}
+
+func ParseTimeRange(from, to string) (time.Time, time.Time, error) {
+	var fromT, toT time.Time
+	var err error
+	if from != "" {
+		fromT, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return fromT, toT, fmt.Errorf("Invalid from time, expected RFC3339")
+		}
+	}
+	if to != "" {
+		toT, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return fromT, toT, fmt.Errorf("Invalid to time, expected RFC3339")
+		}
+	}
+	if !fromT.IsZero() && !toT.IsZero() && toT.Before(fromT) {
+		return fromT, toT, fmt.Errorf("Invalid time range, to is before from")
+	}
+	return fromT, toT, nil
+}
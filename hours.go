@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// OpeningHours is the weekly schedule of a station in its own timezone.
+// A day without periods is closed, a period closing before it opens runs
+// past midnight and "24:00" closes at the end of the day. Exceptions
+// replace the weekly periods on their date, e.g. for holidays.
+type OpeningHours struct {
+	Timezone   string           `json:"timezone"`
+	Weekly     []OpeningPeriod  `json:"weekly"`
+	Exceptions []HoursException `json:"exceptions,omitempty"`
+
+	// loc is the parsed Timezone, cached by Validate.
+	loc *time.Location
+}
+
+type OpeningPeriod struct {
+	Day   string `json:"day"`
+	Open  string `json:"open"`
+	Close string `json:"close"`
+}
+
+type HoursException struct {
+	Date    string          `json:"date"`
+	Closed  bool            `json:"closed"`
+	Periods []OpeningPeriod `json:"periods,omitempty"`
+	Note    string          `json:"note,omitempty"`
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time.
+func parseClock(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || len(s) != 5 {
+		return 0, fmt.Errorf("Invalid time %q, expected HH:MM", s)
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("Invalid time %q, expected HH:MM", s)
+	}
+	return h*60 + m, nil
+}
+
+func (p *OpeningPeriod) minutes() (int, int, error) {
+	open, err := parseClock(p.Open)
+	if err != nil {
+		return 0, 0, err
+	}
+	close, err := parseClock(p.Close)
+	if err != nil {
+		return 0, 0, err
+	}
+	if open == close {
+		return 0, 0, fmt.Errorf("Opening period must not open and close at %s", p.Open)
+	}
+	return open, close, nil
+}
+
+func (h *OpeningHours) Validate() error {
+	loc, err := time.LoadLocation(h.Timezone)
+	if err != nil || h.Timezone == "" {
+		return fmt.Errorf("Invalid timezone %q", h.Timezone)
+	}
+	h.loc = loc
+	for _, p := range h.Weekly {
+		if _, ok := weekdays[p.Day]; !ok {
+			return fmt.Errorf("Invalid day %q, expected mon, tue, wed, thu, fri, sat or sun", p.Day)
+		}
+		if _, _, err := p.minutes(); err != nil {
+			return err
+		}
+	}
+	for _, e := range h.Exceptions {
+		if _, err := time.Parse(time.DateOnly, e.Date); err != nil {
+			return fmt.Errorf("Invalid exception date %q, expected YYYY-MM-DD", e.Date)
+		}
+		for _, p := range e.Periods {
+			if _, _, err := p.minutes(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// periodsOn returns the periods of the given local date, an exception on
+// that date wins over the weekly schedule.
+func (h *OpeningHours) periodsOn(date time.Time) []OpeningPeriod {
+	day := date.Format(time.DateOnly)
+	for _, e := range h.Exceptions {
+		if e.Date == day {
+			if e.Closed {
+				return nil
+			}
+			return e.Periods
+		}
+	}
+
+	periods := make([]OpeningPeriod, 0)
+	for _, p := range h.Weekly {
+		if weekdays[p.Day] == date.Weekday() {
+			periods = append(periods, p)
+		}
+	}
+	return periods
+}
+
+// OpenAt reports whether the station is open at t. Periods that run past
+// midnight are checked on the day they started. Hours that were never
+// validated load their timezone on every call.
+func (h *OpeningHours) OpenAt(t time.Time) bool {
+	if h == nil {
+		return true
+	}
+	loc := h.loc
+	if loc == nil {
+		var err error
+		if loc, err = time.LoadLocation(h.Timezone); err != nil {
+			return true
+		}
+	}
+
+	local := t.In(loc)
+	now := local.Hour()*60 + local.Minute()
+	for _, p := range h.periodsOn(local) {
+		open, close, err := p.minutes()
+		if err != nil {
+			continue
+		}
+		if close > open && now >= open && now < close {
+			return true
+		}
+		if close < open && now >= open {
+			return true
+		}
+	}
+
+	for _, p := range h.periodsOn(local.AddDate(0, 0, -1)) {
+		open, close, err := p.minutes()
+		if err != nil {
+			continue
+		}
+		if close < open && now < close {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *OpeningHours) Copy() *OpeningHours {
+	if h == nil {
+		return nil
+	}
+	cp := *h
+	cp.Weekly = make([]OpeningPeriod, len(h.Weekly))
+	copy(cp.Weekly, h.Weekly)
+	cp.Exceptions = make([]HoursException, len(h.Exceptions))
+	for i, e := range h.Exceptions {
+		cp.Exceptions[i] = e
+		cp.Exceptions[i].Periods = make([]OpeningPeriod, len(e.Periods))
+		copy(cp.Exceptions[i].Periods, e.Periods)
+	}
+	return &cp
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestOpeningHoursCachesLocation(t *testing.T) {
+	hours := &OpeningHours{
+		Timezone: "Europe/Zagreb",
+		Weekly:   []OpeningPeriod{{Day: "fri", Open: "22:00", Close: "06:00"}},
+	}
+	if err := hours.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cp := hours.Copy()
+	if cp.loc == nil || cp.loc != hours.loc {
+		t.Fatal("Validated location was not kept by the copy")
+	}
+
+	// Friday 22:30 and Saturday 03:00 in Zagreb, CET is UTC+1.
+	if !cp.OpenAt(time.Date(2024, 3, 1, 21, 30, 0, 0, time.UTC)) {
+		t.Fatal("Station is closed on Friday night")
+	}
+	if !cp.OpenAt(time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC)) {
+		t.Fatal("Station is closed past midnight")
+	}
+	if cp.OpenAt(time.Date(2024, 3, 2, 6, 0, 0, 0, time.UTC)) {
+		t.Fatal("Station is open on Saturday morning")
+	}
+}
+
+func TestStationViewReportsOpen(t *testing.T) {
+	body, err := json.Marshal(&StationView{Station: &Station{ID: 1}, Open: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := make(map[string]interface{})
+	if err := json.Unmarshal(body, &view); err != nil {
+		t.Fatal(err)
+	}
+	if view["id"] != float64(1) || view["open"] != true {
+		t.Fatalf("Unexpected view %s", body)
+	}
+
+	body, err = json.Marshal(&Station{ID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	station := make(map[string]interface{})
+	if err := json.Unmarshal(body, &station); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := station["open"]; ok {
+		t.Fatal("Stored station has an open field")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	ImportAtomic     = "atomic"
+	ImportBestEffort = "best_effort"
+)
+
+type ImportRowErrorDto struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+type ImportResultDto struct {
+	Mode     string              `json:"mode"`
+	DryRun   bool                `json:"dry_run"`
+	Total    int                 `json:"total"`
+	Valid    int                 `json:"valid"`
+	Created  int                 `json:"created"`
+	Failed   int                 `json:"failed"`
+	Stations []uint64            `json:"station_ids"`
+	Errors   []ImportRowErrorDto `json:"errors"`
+}
+
+type ImportRow struct {
+	Row     int
+	Station *StationDto
+	Err     error
+}
+
+func NewImportResultDto(mode string, dryRun bool) *ImportResultDto {
+	return &ImportResultDto{
+		Mode:     mode,
+		DryRun:   dryRun,
+		Stations: make([]uint64, 0),
+		Errors:   make([]ImportRowErrorDto, 0),
+	}
+}
+
+func ValidImportMode(m string) bool {
+	return m == ImportAtomic ||
+		m == ImportBestEffort
+}
+
+// csvStationColumns are the columns ParseStationsCSV reads besides the
+// price_<gas type> ones.
+var csvStationColumns = map[string]bool{
+	"name":           true,
+	"address":        true,
+	"latitude":       true,
+	"longitude":      true,
+	"supported_fuel": true,
+	"amenities":      true,
+	"brand_id":       true,
+	"external_id":    true,
+	"opening_hours":  true,
+}
+
+// ParseStationsCSV reads one station per line. supported_fuel and the
+// optional amenities column are separated by semicolons, opening_hours
+// holds the schedule as a JSON object and every price_<gas type> column
+// sets the price of that gas type. Unknown columns are rejected rather
+// than dropped. Rows are numbered from 1, not counting the header.
+func ParseStationsCSV(r io.Reader) ([]*ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read CSV header: %v", err)
+	}
+	cols := make(map[string]int)
+	for i, h := range header {
+		c := strings.ToLower(strings.TrimSpace(h))
+		if !csvStationColumns[c] && !strings.HasPrefix(c, "price_") {
+			return nil, fmt.Errorf("CSV has unknown column %s", c)
+		}
+		cols[c] = i
+	}
+	for _, c := range []string{"name", "address", "latitude", "longitude", "supported_fuel"} {
+		if _, ok := cols[c]; !ok {
+			return nil, fmt.Errorf("CSV is missing column %s", c)
+		}
+	}
+
+	rows := make([]*ImportRow, 0)
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		row := &ImportRow{Row: n}
+		rows = append(rows, row)
+		if err != nil {
+			row.Err = fmt.Errorf("Failed to read CSV row: %v", err)
+			continue
+		}
+		row.Station, row.Err = stationDtoFromCSV(record, cols)
+	}
+
+	return rows, nil
+}
+
+func stationDtoFromCSV(record []string, cols map[string]int) (*StationDto, error) {
+	get := func(c string) string {
+		i, ok := cols[c]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	lat, err := strconv.ParseFloat(get("latitude"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid latitude")
+	}
+	lon, err := strconv.ParseFloat(get("longitude"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid longitude")
+	}
+
+	dto := &StationDto{
+		ExternalID:    get("external_id"),
+		Name:          get("name"),
+		Address:       get("address"),
+		SupportedFuel: make([]GasType, 0),
+		Location: Location{
+			Latitude:  lat,
+			Longitude: lon,
+		},
+		CurrentPrice: make(map[GasType]float64),
+	}
+	for _, f := range strings.Split(get("supported_fuel"), ";") {
+		if f = strings.TrimSpace(f); f != "" {
+			dto.SupportedFuel = append(dto.SupportedFuel, GasType(f))
+		}
+	}
+	dto.Amenities = ParseAmenities(get("amenities"), ";")
+	if v := get("brand_id"); v != "" {
+		if dto.BrandID, err = strconv.ParseUint(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid brand_id")
+		}
+	}
+	if v := get("opening_hours"); v != "" {
+		dto.Hours = new(OpeningHours)
+		if err := json.Unmarshal([]byte(v), dto.Hours); err != nil {
+			return nil, fmt.Errorf("Invalid opening_hours: %v", err)
+		}
+	}
+	for c := range cols {
+		gt, ok := strings.CutPrefix(c, "price_")
+		if !ok || get(c) == "" {
+			continue
+		}
+		p, err := strconv.ParseFloat(get(c), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid price in column %s", c)
+		}
+		dto.CurrentPrice[GasType(gt)] = p
+	}
+
+	return dto, nil
+}
+
+// ParseStationsJSON reads a JSON array of stations, decoding every element
+// on its own so one malformed station does not hide errors in the others.
+func ParseStationsJSON(r io.Reader) ([]*ImportRow, error) {
+	raw := make([]json.RawMessage, 0)
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("Failed to parse JSON array: %v", err)
+	}
+
+	rows := make([]*ImportRow, 0, len(raw))
+	for i, msg := range raw {
+		row := &ImportRow{Row: i + 1}
+		dto := new(StationDto)
+		if err := json.Unmarshal(msg, dto); err != nil {
+			row.Err = fmt.Errorf("Failed to parse station: %v", err)
+		} else {
+			row.Station = dto
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func ParseStationsImport(r io.Reader, format string) ([]*ImportRow, error) {
+	switch format {
+	case "csv":
+		return ParseStationsCSV(r)
+	case "json":
+		return ParseStationsJSON(r)
+	}
+	return nil, fmt.Errorf("Invalid import format, expected csv or json")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStationsCSVReadsAllStationColumns(t *testing.T) {
+	csv := "name,address,latitude,longitude,supported_fuel,brand_id,external_id,opening_hours,price_diesel\n" +
+		`Zagreb,Ilica 1,45.81,15.97,diesel,3,mingor:10,"{""timezone"": ""Europe/Zagreb"", ""weekly"": [{""day"": ""mon"", ""open"": ""06:00"", ""close"": ""22:00""}]}",1.45` + "\n"
+	rows, err := ParseStationsCSV(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Err != nil {
+		t.Fatalf("Unexpected rows %+v", rows)
+	}
+	st := rows[0].Station
+	if st.BrandID != 3 || st.ExternalID != "mingor:10" || st.Hours == nil || st.Hours.Timezone != "Europe/Zagreb" || len(st.Hours.Weekly) != 1 {
+		t.Fatalf("Columns were dropped: %+v", st)
+	}
+
+	if _, err := ParseStationsCSV(strings.NewReader("name,address,latitude,longitude,supported_fuel,ev_connectors\n")); err == nil {
+		t.Fatal("Unknown column was accepted")
+	}
+}
+
+func TestValidateStationDtoChecksBrand(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, _ := newTestStorage(t, NewSimConfig(clock, 7))
+	brand, err := storage.CreateBrand(&BrandDto{Name: "Petrol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dto := testStationDto("Zagreb", 45.81, 15.97)
+	dto.BrandID = brand.ID
+	if err := ValidateStationDto(storage, dto); err != nil {
+		t.Fatalf("Station of an existing brand was rejected: %v", err)
+	}
+	dto.BrandID = brand.ID + 1
+	if err := ValidateStationDto(storage, dto); err == nil {
+		t.Fatal("Station of a missing brand was accepted")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLeaseHeld    = errors.New("Lease is held by another instance")
+	ErrLeaseExpired = errors.New("Lease expired before it was renewed")
+)
+
+// Lease is held by one instance until it expires, the holder keeps it by
+// acquiring it again before then. Leases are shared between processes so
+// they use wall time rather than the simulation clock.
+type Lease struct {
+	Name       string    `json:"name"`
+	Holder     string    `json:"holder"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// LeaseStore hands out leases. AcquireLease both takes a free or expired
+// lease and renews one the holder already has, it fails with ErrLeaseHeld
+// while another holder has it. GetLease returns nil for a free lease.
+type LeaseStore interface {
+	AcquireLease(name, holder string, ttl time.Duration) (*Lease, error)
+	ReleaseLease(name, holder string) error
+	GetLease(name string) (*Lease, error)
+}
+
+// LeaderStatusDto describes the election, a standalone instance does not
+// share its stations and always leads.
+type LeaderStatusDto struct {
+	Instance   string `json:"instance,omitempty"`
+	IsLeader   bool   `json:"is_leader"`
+	Standalone bool   `json:"standalone,omitempty"`
+	Lease      *Lease `json:"lease"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+// LeaderElector keeps trying to hold the lease and reports every change of
+// leadership to onChange. The changes are reported in order from their own
+// goroutine without any lock held, so a slow onChange delays neither the
+// renewals nor the watchdog. A leader that fails to renew steps down right
+// away, and so does one whose renewal is still waiting on the store once
+// the ttl has passed since the last renewal started. Two instances never
+// act as leader while the store is in doubt.
+type LeaderElector struct {
+	store     LeaseStore
+	name      string
+	instance  string
+	ttl       time.Duration
+	onChange  func(bool)
+	notify    chan struct{}
+	reported  bool
+	leader    bool
+	expiresAt time.Time
+	lastErr   error
+	mu        sync.Mutex
+}
+
+func NewLeaderElector(store LeaseStore, name, instance string, ttl time.Duration, onChange func(bool)) (*LeaderElector, error) {
+	if ttl < 3*time.Second {
+		return nil, fmt.Errorf("Leader lease must last at least 3s")
+	}
+	return &LeaderElector{
+		store:    store,
+		name:     name,
+		instance: instance,
+		ttl:      ttl,
+		onChange: onChange,
+		notify:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Run renews the lease three times per ttl until ctx ends, then releases
+// it so another instance can take over without waiting for it to expire.
+// It returns once the step down is reported and the lease released.
+func (e *LeaderElector) Run(ctx context.Context) {
+	reported := make(chan struct{})
+	go func() {
+		defer close(reported)
+		e.reportChanges(ctx)
+	}()
+	watchdog := time.AfterFunc(e.ttl, e.expire)
+	defer watchdog.Stop()
+
+	for {
+		if expiresAt, ok := e.tick(); ok {
+			watchdog.Reset(time.Until(expiresAt))
+		}
+		select {
+		case <-ctx.Done():
+			watchdog.Stop()
+			e.setLeader(false, time.Time{}, nil)
+			<-reported
+			e.report()
+			if err := e.store.ReleaseLease(e.name, e.instance); err != nil && !errors.Is(err, ErrLeaseHeld) {
+				log.Printf("Failed to release leader lease: %v", err)
+			}
+			return
+		case <-time.After(e.ttl / 3):
+		}
+	}
+}
+
+// tick acquires or renews the lease and returns when it expires at the
+// latest. The store sets the expiry after the call started, so counting
+// the ttl from the start never outlives the lease.
+func (e *LeaderElector) tick() (time.Time, bool) {
+	start := time.Now()
+	_, err := e.store.AcquireLease(e.name, e.instance, e.ttl)
+	expiresAt := start.Add(e.ttl)
+	if err == nil && !time.Now().Before(expiresAt) {
+		err = ErrLeaseExpired
+	}
+	if err != nil && !errors.Is(err, ErrLeaseHeld) {
+		log.Printf("Failed to acquire leader lease: %v", err)
+		e.setLeader(false, time.Time{}, err)
+		return time.Time{}, false
+	}
+	if err != nil {
+		e.setLeader(false, time.Time{}, nil)
+		return time.Time{}, false
+	}
+	e.setLeader(true, expiresAt, nil)
+	return expiresAt, true
+}
+
+// expire steps down when the lease was not renewed in time, e.g. while
+// the store does not answer.
+func (e *LeaderElector) expire() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.leader && !time.Now().Before(e.expiresAt) {
+		log.Printf("Leader lease of instance %s expired before it was renewed", e.instance)
+		e.setLeaderLocked(false, time.Time{}, ErrLeaseExpired)
+	}
+}
+
+func (e *LeaderElector) setLeader(leader bool, expiresAt time.Time, lastErr error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.setLeaderLocked(leader, expiresAt, lastErr)
+}
+
+func (e *LeaderElector) setLeaderLocked(leader bool, expiresAt time.Time, lastErr error) {
+	changed := e.leader != leader
+	e.leader = leader
+	e.expiresAt = expiresAt
+	e.lastErr = lastErr
+
+	if changed {
+		select {
+		case e.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *LeaderElector) reportChanges(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.notify:
+			e.report()
+		}
+	}
+}
+
+// report hands the current leadership to onChange unless it was already
+// reported, changes that were undone meanwhile are never reported.
+func (e *LeaderElector) report() {
+	e.mu.Lock()
+	leader := e.leader
+	e.mu.Unlock()
+
+	if leader == e.reported {
+		return
+	}
+	e.reported = leader
+	if leader {
+		log.Printf("Instance %s is now the leader", e.instance)
+	} else {
+		log.Printf("Instance %s is no longer the leader", e.instance)
+	}
+	e.onChange(leader)
+}
+
+func (e *LeaderElector) Status() (*LeaderStatusDto, error) {
+	lease, err := e.store.GetLease(e.name)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	status := &LeaderStatusDto{
+		Instance: e.instance,
+		IsLeader: e.leader,
+		Lease:    lease,
+	}
+	if e.lastErr != nil {
+		status.LastError = e.lastErr.Error()
+	}
+	return status, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRESPServer(t *testing.T) *RESPServer {
+	t.Helper()
+	srv, err := NewRESPServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// leadershipLog records the leadership changes of several electors in the
+// order they are reported.
+type leadershipLog struct {
+	changes chan string
+}
+
+func newLeadershipLog() *leadershipLog {
+	return &leadershipLog{changes: make(chan string, 16)}
+}
+
+func (l *leadershipLog) onChange(instance string) func(bool) {
+	return func(leader bool) {
+		if leader {
+			l.changes <- instance + " leads"
+		} else {
+			l.changes <- instance + " steps down"
+		}
+	}
+}
+
+func (l *leadershipLog) expect(t *testing.T, change string, within time.Duration) {
+	t.Helper()
+	select {
+	case got := <-l.changes:
+		if got != change {
+			t.Fatalf("Got %q, want %q", got, change)
+		}
+	case <-time.After(within):
+		t.Fatalf("Timed out waiting for %q", change)
+	}
+}
+
+func (l *leadershipLog) expectNone(t *testing.T, within time.Duration) {
+	t.Helper()
+	select {
+	case got := <-l.changes:
+		t.Fatalf("Unexpected change %q", got)
+	case <-time.After(within):
+	}
+}
+
+func TestLeaderElectorFailsOverOnShutdown(t *testing.T) {
+	srv := newTestRESPServer(t)
+	changes := newLeadershipLog()
+	newElector := func(instance string) *LeaderElector {
+		e, err := NewLeaderElector(NewRedisLeaseStore(srv.Addr(), "test:"), "generators", instance, 3*time.Second, changes.onChange(instance))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	a := newElector("a")
+	doneA := make(chan struct{})
+	go func() {
+		defer close(doneA)
+		a.Run(ctxA)
+	}()
+	changes.expect(t, "a leads", time.Second)
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+	b := newElector("b")
+	go b.Run(ctxB)
+	changes.expectNone(t, 1500*time.Millisecond)
+
+	cancelA()
+	<-doneA
+	changes.expect(t, "a steps down", time.Second)
+	changes.expect(t, "b leads", 2*time.Second)
+
+	status, err := a.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.IsLeader || status.Lease == nil || status.Lease.Holder != "b" {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+}
+
+// stalledLeaseStore stops answering acquisitions once stalled, like a
+// store behind a hung connection.
+type stalledLeaseStore struct {
+	LeaseStore
+	stalled chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (s *stalledLeaseStore) stall() {
+	s.once.Do(func() { close(s.stalled) })
+}
+
+func (s *stalledLeaseStore) AcquireLease(name, holder string, ttl time.Duration) (*Lease, error) {
+	select {
+	case <-s.stalled:
+		<-s.done
+		return nil, fmt.Errorf("Connection closed")
+	default:
+	}
+	return s.LeaseStore.AcquireLease(name, holder, ttl)
+}
+
+func TestLeaderElectorStepsDownWhenRenewalStalls(t *testing.T) {
+	srv := newTestRESPServer(t)
+	changes := newLeadershipLog()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := &stalledLeaseStore{
+		LeaseStore: NewRedisLeaseStore(srv.Addr(), "test:"),
+		stalled:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	defer close(store.done)
+	a, err := NewLeaderElector(store, "generators", "a", 3*time.Second, changes.onChange("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go a.Run(ctx)
+	changes.expect(t, "a leads", time.Second)
+
+	b, err := NewLeaderElector(NewRedisLeaseStore(srv.Addr(), "test:"), "generators", "b", 3*time.Second, changes.onChange("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Run(ctx)
+
+	// a hangs in its next renewal, it has to step down on its own before
+	// the lease expires on the server and b takes over.
+	store.stall()
+	changes.expect(t, "a steps down", 4*time.Second)
+	changes.expect(t, "b leads", 2*time.Second)
+
+	status, err := a.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.IsLeader || status.LastError != ErrLeaseExpired.Error() {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+}
+
+func TestSupervisorStandbyKeepsLocalStationsGenerating(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, supervisor := newTestStorage(t, NewSimConfig(clock, 7))
+	supervisor.SetActive(false)
+
+	shared := testStationDto("Shared", 45.81, 15.97)
+	shared.ExternalID = "mingor:10"
+	sharedStation, err := storage.CreateStation(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	localStation, err := storage.CreateStation(testStationDto("Local", 43.51, 16.44))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	states := func() map[uint64]GeneratorState {
+		states := make(map[uint64]GeneratorState)
+		for _, s := range supervisor.Status() {
+			states[s.StationID] = s.State
+		}
+		return states
+	}
+	if s := states(); s[sharedStation.ID] != GeneratorStandby || s[localStation.ID] != GeneratorRunning {
+		t.Fatalf("Unexpected states on standby %v", s)
+	}
+	supervisor.SetActive(true)
+	if s := states(); s[sharedStation.ID] != GeneratorRunning || s[localStation.ID] != GeneratorRunning {
+		t.Fatalf("Unexpected states when leading %v", s)
+	}
+}
+
+func TestLeaderElectorReportsWithoutHoldingItsLock(t *testing.T) {
+	srv := newTestRESPServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var e *LeaderElector
+	statuses := make(chan *LeaderStatusDto, 2)
+	e, err := NewLeaderElector(NewRedisLeaseStore(srv.Addr(), "test:"), "generators", "a", 3*time.Second, func(bool) {
+		// Reading the status from onChange deadlocks if it runs under the
+		// elector's lock.
+		status, err := e.Status()
+		if err != nil {
+			t.Error(err)
+		}
+		statuses <- status
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(ctx)
+	}()
+
+	select {
+	case status := <-statuses:
+		if !status.IsLeader {
+			t.Fatalf("Unexpected status %+v", status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Leadership was not reported")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run did not return")
+	}
+	if status := <-statuses; status.IsLeader {
+		t.Fatalf("Step down not reported: %+v", status)
+	}
+	status, err := e.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Lease != nil {
+		t.Fatalf("Lease not released on shutdown: %+v", status)
+	}
+}
@@ -1,6 +1,13 @@
 package main
 
-import "os"
+import (
+    "context"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "time"
+)
 
 func main() {
     os.Setenv("JWT_SECRET", "GOGOGOGO")
@@ -8,7 +15,232 @@ func main() {
     os.Setenv("ADMIN_PASS", "admin")
     os.Setenv("ADMIN_EMAIL", "admin@email.go")
 
-    ramstore := NewRAMStorage()
-    server := NewAPIServer(":8080", ramstore)
+    if len(os.Args) > 1 && os.Args[1] == "import" {
+        if err := runImportCommand(os.Args[2:]); err != nil {
+            log.Fatalln(err)
+        }
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "broker-server" {
+        if err := runBrokerServerCommand(os.Args[2:]); err != nil {
+            log.Fatalln(err)
+        }
+        return
+    }
+
+    sim := simConfigFromEnv()
+    log.Println("Simulation seed:", sim.Seed)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    id := instanceID()
+    broker := brokerFromEnv(ctx, id)
+    supervisor := NewGeneratorSupervisor(sim.Clock, broker)
+    elector := leaderElectorFromEnv(id, supervisor)
+    elected := make(chan struct{})
+    if elector != nil {
+        // Generators of shared stations wait until this instance is elected.
+        supervisor.SetActive(false)
+        go func() {
+            defer close(elected)
+            elector.Run(ctx)
+        }()
+    } else {
+        close(elected)
+    }
+    market := NewMarket(sim)
+    events := NewEventLog(eventLogSizeFromEnv())
+    ramstore := NewRAMStorage(sim, supervisor, market, events)
+    if rb, ok := broker.(*RedisBroker); ok {
+        rb.SetStationResolver(ramstore.StationIDByExternalID)
+    }
+    compactor := NewHistoryCompactor(ramstore, retentionPolicyFromEnv(), sim.Clock)
+    audit := NewRAMAuditStore(sim.Clock)
+    purger := trashPurgerFromEnv(ramstore, audit, sim.Clock)
+
+    go compactor.Run(ctx)
+    go purger.Run(ctx)
+    go events.Forward(ctx, broker)
+
+    openData := NewOpenDataImporter(ramstore, audit, os.Getenv("OPENDATA_URL"), nil)
+    if path := os.Getenv("OPENDATA_FILE"); path != "" {
+        result, err := openData.ImportFile(path)
+        if err != nil {
+            log.Fatalf("Failed to import open data: %v", err)
+        }
+        log.Printf("Imported open data: %d created, %d updated, %d skipped", result.Created, result.Updated, result.Skipped)
+    }
+
+    server := NewAPIServer(":8080", ramstore, audit, supervisor, market, compactor, openData, purger, events, broker, elector)
+    // Start returns on SIGINT or SIGTERM, the lease is released before
+    // exiting so another instance takes over right away.
     server.Start()
+    cancel()
+    <-elected
+}
+
+func retentionPolicyFromEnv() *RetentionPolicy {
+    durations := map[string]time.Duration{
+        "RETENTION_RAW":      7 * 24 * time.Hour,
+        "RETENTION_HOURLY":   90 * 24 * time.Hour,
+        "RETENTION_DAILY":    2 * 365 * 24 * time.Hour,
+        "RETENTION_INTERVAL": time.Hour,
+    }
+    for name := range durations {
+        if v := os.Getenv(name); v != "" {
+            d, err := ParseDayDuration(v)
+            if err != nil {
+                log.Fatalf("Invalid %s: %v", name, err)
+            }
+            durations[name] = d
+        }
+    }
+
+    policy, err := NewRetentionPolicy(
+        durations["RETENTION_RAW"],
+        durations["RETENTION_HOURLY"],
+        durations["RETENTION_DAILY"],
+        durations["RETENTION_INTERVAL"],
+    )
+    if err != nil {
+        log.Fatalf("Invalid retention policy: %v", err)
+    }
+    return policy
+}
+
+func trashPurgerFromEnv(storage Storage, audit AuditStore, clock Clock) *TrashPurger {
+    durations := map[string]time.Duration{
+        "TRASH_GRACE":          30 * 24 * time.Hour,
+        "TRASH_PURGE_INTERVAL": time.Hour,
+    }
+    for name := range durations {
+        if v := os.Getenv(name); v != "" {
+            d, err := ParseDayDuration(v)
+            if err != nil || d <= 0 {
+                log.Fatalf("Invalid %s: %s", name, v)
+            }
+            durations[name] = d
+        }
+    }
+
+    return NewTrashPurger(storage, audit, durations["TRASH_GRACE"], durations["TRASH_PURGE_INTERVAL"], clock)
+}
+
+// brokerFromEnv shares generated and recorded prices with the other
+// instances over Redis pub/sub when BROKER_ADDR is set. Only prices of
+// stations with an external id, e.g. from the open data import, are shared
+// and replicas record them on their station with the same external id, so
+// their streaming clients see every change.
+func brokerFromEnv(ctx context.Context, id string) Broker {
+    addr := os.Getenv("BROKER_ADDR")
+    if addr == "" {
+        return NewMemoryBroker()
+    }
+
+    broker := NewRedisBroker(addr, brokerPrefix(), id, []string{TopicPriceGenerated, TopicPriceRecorded})
+    go broker.Run(ctx)
+    log.Printf("Sharing price events over %s", addr)
+    return broker
+}
+
+func brokerPrefix() string {
+    if prefix := os.Getenv("BROKER_PREFIX"); prefix != "" {
+        return prefix
+    }
+    return "gas_prices:"
+}
+
+// leaderElectorFromEnv elects the instance running the generators of the
+// shared stations. The lease lives on the broker's Redis, without
+// BROKER_ADDR the instance runs standalone and nil is returned.
+// LEADER_LEASE_TTL defaults to 15s.
+func leaderElectorFromEnv(id string, supervisor *GeneratorSupervisor) *LeaderElector {
+    addr := os.Getenv("BROKER_ADDR")
+    if addr == "" {
+        return nil
+    }
+    leases := NewRedisLeaseStore(addr, brokerPrefix())
+
+    ttl := 15 * time.Second
+    if v := os.Getenv("LEADER_LEASE_TTL"); v != "" {
+        d, err := ParseDayDuration(v)
+        if err != nil {
+            log.Fatalf("Invalid LEADER_LEASE_TTL: %s", v)
+        }
+        ttl = d
+    }
+
+    elector, err := NewLeaderElector(leases, "generators", id, ttl, supervisor.SetActive)
+    if err != nil {
+        log.Fatalf("Invalid leader election: %v", err)
+    }
+    return elector
+}
+
+// instanceID names this process among the replicas, INSTANCE_ID defaults
+// to the host name and process id.
+func instanceID() string {
+    if id := os.Getenv("INSTANCE_ID"); id != "" {
+        return id
+    }
+    host, err := os.Hostname()
+    if err != nil {
+        host = "localhost"
+    }
+    return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func eventLogSizeFromEnv() int {
+    size := 100000
+    if v := os.Getenv("EVENT_LOG_SIZE"); v != "" {
+        parsed, err := strconv.Atoi(v)
+        if err != nil || parsed <= 0 {
+            log.Fatalf("Invalid EVENT_LOG_SIZE: %s", v)
+        }
+        size = parsed
+    }
+    return size
+}
+
+func simConfigFromEnv() *SimConfig {
+    seed := time.Now().UnixNano()
+    if v := os.Getenv("SIM_SEED"); v != "" {
+        parsed, err := strconv.ParseInt(v, 10, 64)
+        if err != nil {
+            log.Fatalf("Invalid SIM_SEED: %v", err)
+        }
+        seed = parsed
+    }
+
+    var clock Clock = NewRealClock()
+    if v := os.Getenv("SIM_SPEED"); v != "" {
+        speed, err := strconv.ParseFloat(v, 64)
+        if err != nil || speed <= 0 {
+            log.Fatalf("Invalid SIM_SPEED: %s", v)
+        }
+        clock = NewScaledClock(speed)
+    }
+
+    sim := NewSimConfig(clock, seed)
+    if path := os.Getenv("REPLAY_FILE"); path != "" {
+        timeline, err := LoadReplayTimeline(path)
+        if err != nil {
+            log.Fatalf("Failed to load replay file: %v", err)
+        }
+        speed := 1.0
+        if v := os.Getenv("REPLAY_SPEED"); v != "" {
+            speed, err = strconv.ParseFloat(v, 64)
+            if err != nil || speed <= 0 {
+                log.Fatalf("Invalid REPLAY_SPEED: %s", v)
+            }
+        }
+        sim.Replay = &ReplayConfig{
+            Timeline: timeline,
+            Speed:    speed,
+            Loop:     os.Getenv("REPLAY_LOOP") == "true",
+        }
+    }
+
+    return sim
 }
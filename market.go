@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+type MarketShock struct {
+	ID      uint64    `json:"id"`
+	GasType GasType   `json:"gas_type"`
+	Region  string    `json:"region,omitempty"`
+	Percent float64   `json:"percent"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+}
+
+type MarketShockDto struct {
+	GasType  GasType `json:"gas_type"`
+	Region   string  `json:"region"`
+	Percent  float64 `json:"percent"`
+	Duration string  `json:"duration"`
+}
+
+type MarketFactorDto struct {
+	GasType GasType `json:"gas_type"`
+	Region  string  `json:"region,omitempty"`
+	Factor  float64 `json:"factor"`
+}
+
+type marketKey struct {
+	gasType GasType
+	region  string
+}
+
+// marketWindow is the number of intervals of market history kept. A price
+// older than that follows the market from the start of the window.
+const marketWindow = 1024
+
+// marketWalk keeps the levels from step first on. shift is the lasting
+// effect of the shocks that ended before the window.
+type marketWalk struct {
+	rnd    *rand.Rand
+	first  int
+	levels []float64
+	shift  float64
+}
+
+// Market is the factor shared by every station selling the same fuel,
+// nationally (empty region) and per region. Each factor is a random walk
+// stepped once per interval multiplied by any shocks injected by admins.
+type Market struct {
+	clock    Clock
+	seed     int64
+	start    time.Time
+	interval time.Duration
+	sigma    float64
+	walks    map[marketKey]*marketWalk
+	shocks   []*MarketShock
+	nextId   uint64
+	mu       sync.Mutex
+}
+
+func NewMarket(sim *SimConfig) *Market {
+	return &Market{
+		clock:    sim.Clock,
+		seed:     sim.Seed,
+		start:    sim.Clock.Now(),
+		interval: sim.Interval,
+		sigma:    0.001,
+		walks:    make(map[marketKey]*marketWalk),
+		shocks:   make([]*MarketShock, 0),
+	}
+}
+
+func NewMarketShock(id uint64, dto *MarketShockDto, start time.Time) (*MarketShock, error) {
+	if dto.Percent <= -100 {
+		return nil, fmt.Errorf("Invalid percent, price can not drop by 100%% or more")
+	}
+
+	var d time.Duration
+	if dto.Duration != "" {
+		parsed, err := time.ParseDuration(dto.Duration)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("Invalid duration")
+		}
+		d = parsed
+	}
+
+	return &MarketShock{
+		ID:      id,
+		GasType: dto.GasType,
+		Region:  dto.Region,
+		Percent: dto.Percent,
+		Start:   start,
+		End:     start.Add(d),
+	}, nil
+}
+
+func (m *Market) AddShock(dto *MarketShockDto) (*MarketShock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.nextId++
+	shock, err := NewMarketShock(m.nextId, dto, m.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	m.shocks = append(m.shocks, shock)
+	return shock, nil
+}
+
+func (m *Market) GetShocks() []*MarketShock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	shocks := make([]*MarketShock, len(m.shocks))
+	for i, sh := range m.shocks {
+		cp := *sh
+		shocks[i] = &cp
+	}
+	return shocks
+}
+
+func (m *Market) GetFactors() []*MarketFactorDto {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make(map[marketKey]bool)
+	for k := range m.walks {
+		keys[k] = true
+	}
+	for _, sh := range m.shocks {
+		keys[marketKey{gasType: sh.GasType, region: sh.Region}] = true
+	}
+
+	now := m.clock.Now()
+	oldest := m.pruneLocked()
+	factors := make([]*MarketFactorDto, 0, len(keys))
+	for k := range keys {
+		factors = append(factors, &MarketFactorDto{
+			GasType: k.gasType,
+			Region:  k.region,
+			Factor:  m.factorLocked(k, now, oldest),
+		})
+	}
+	sort.Slice(factors, func(i, j int) bool {
+		if factors[i].GasType != factors[j].GasType {
+			return factors[i].GasType < factors[j].GasType
+		}
+		return factors[i].Region < factors[j].Region
+	})
+	return factors
+}
+
+// Factor returns the combined national and regional market level of the
+// gas type at t. Generators use the ratio of two factors to move a price.
+func (m *Market) Factor(gt GasType, regions []string, t time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldest := m.pruneLocked()
+	f := m.factorLocked(marketKey{gasType: gt}, t, oldest)
+	for _, r := range regions {
+		if r == "" {
+			continue
+		}
+		f *= m.factorLocked(marketKey{gasType: gt, region: r}, t, oldest)
+	}
+	return f
+}
+
+// pruneLocked returns the start of the kept window and folds the shocks
+// that ended before it into their walk, their effect lasts.
+func (m *Market) pruneLocked() time.Time {
+	if m.interval <= 0 {
+		return time.Time{}
+	}
+	oldest := m.clock.Now().Add(-marketWindow * m.interval)
+
+	shocks := make([]*MarketShock, 0, len(m.shocks))
+	for _, sh := range m.shocks {
+		if sh.End.Before(oldest) {
+			w := m.walkLocked(marketKey{gasType: sh.GasType, region: sh.Region})
+			w.shift *= sh.multiplier(sh.End)
+			continue
+		}
+		shocks = append(shocks, sh)
+	}
+	m.shocks = shocks
+	return oldest
+}
+
+func (m *Market) factorLocked(k marketKey, t, oldest time.Time) float64 {
+	if t.Before(oldest) {
+		t = oldest
+	}
+	f := m.walkLevelLocked(k, t, oldest)
+	if w, ok := m.walks[k]; ok {
+		f *= w.shift
+	}
+	for _, sh := range m.shocks {
+		if sh.GasType == k.gasType && sh.Region == k.region {
+			f *= sh.multiplier(t)
+		}
+	}
+	return f
+}
+
+// Every walk gets its own generator seeded from the market seed and its
+// key, so levels do not depend on the order stations ask for them.
+func (m *Market) walkLocked(k marketKey) *marketWalk {
+	w, ok := m.walks[k]
+	if !ok {
+		h := fnv.New64a()
+		h.Write([]byte(string(k.gasType) + "|" + k.region))
+		w = &marketWalk{
+			rnd:    rand.New(rand.NewSource(m.seed ^ int64(h.Sum64()))),
+			levels: []float64{1},
+			shift:  1,
+		}
+		m.walks[k] = w
+	}
+	return w
+}
+
+// walkLevelLocked steps the walk up to t, which must not be before oldest,
+// and drops the levels before oldest once a window of them piled up.
+func (m *Market) walkLevelLocked(k marketKey, t, oldest time.Time) float64 {
+	if m.interval <= 0 || t.Before(m.start) {
+		return 1
+	}
+	step := int(t.Sub(m.start) / m.interval)
+
+	w := m.walkLocked(k)
+	for w.first+len(w.levels) <= step {
+		prev := w.levels[len(w.levels)-1]
+		next := prev * math.Exp(-0.5*m.sigma*m.sigma+m.sigma*w.rnd.NormFloat64())
+		w.levels = append(w.levels, next)
+	}
+	if !oldest.Before(m.start) {
+		if drop := int(oldest.Sub(m.start)/m.interval) - w.first; drop >= marketWindow {
+			w.levels = append([]float64(nil), w.levels[drop:]...)
+			w.first += drop
+		}
+	}
+	return w.levels[step-w.first]
+}
+
+func (sh *MarketShock) multiplier(t time.Time) float64 {
+	if t.Before(sh.Start) {
+		return 1
+	}
+	progress := 1.0
+	if t.Before(sh.End) {
+		progress = float64(t.Sub(sh.Start)) / float64(sh.End.Sub(sh.Start))
+	}
+	return 1 + sh.Percent/100*progress
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMarketKeepsBoundedHistory(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	sim := NewSimConfig(clock, 7)
+	market := NewMarket(sim)
+	// Only asked at the end, the reference walks the same levels in one go.
+	reference := NewMarket(sim)
+	if _, err := market.AddShock(&MarketShockDto{GasType: "diesel", Percent: 10, Duration: "1h"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5*marketWindow; i++ {
+		clock.Advance(sim.Interval)
+		market.Factor("diesel", nil, clock.Now())
+	}
+
+	w := market.walks[marketKey{gasType: "diesel"}]
+	if len(w.levels) > 2*marketWindow {
+		t.Fatalf("Market keeps %d levels", len(w.levels))
+	}
+	if len(market.GetShocks()) != 0 {
+		t.Fatal("Ended shock was kept")
+	}
+
+	now := clock.Now()
+	want := reference.Factor("diesel", nil, now) * 1.1
+	if got := market.Factor("diesel", nil, now); math.Abs(got-want) > 1e-9 {
+		t.Fatalf("Pruned market factor %v, want %v", got, want)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"math"
 	"time"
 )
@@ -9,21 +11,41 @@ type GasType string
 
 const EarthRadius = 6371
 
-func ValidGasType(g string) bool {
-	return g == "diesel" ||
-		g == "gasoline" ||
-		g == "gas"
+type HistPriceGasTypeDto struct {
+	GasType       GasType          `json:"gas_type"`
+	Bucket        string           `json:"bucket,omitempty"`
+	HistoryPrices []PricePointDto  `json:"history_prices,omitempty"`
+	Buckets       []PriceBucketDto `json:"buckets,omitempty"`
 }
 
-type HistPriceGasTypeDto struct {
-	HistoryPrices map[time.Time]float64 `json:"history_prices"`
+type PricePointDto struct {
+	Time  time.Time `json:"time"`
+	Price float64   `json:"price"`
+}
+
+type PriceBucketDto struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Open  float64   `json:"open"`
+	High  float64   `json:"high"`
+	Low   float64   `json:"low"`
+	Close float64   `json:"close"`
+	Avg   float64   `json:"avg"`
+	Count int       `json:"count"`
 }
 
 type User struct {
-	ID            uint64 `json:"id"`
-	Username      string `json:"username"`
-	CryptPassword string `json:"password"`
-	Email         string `json:"email"`
+	ID            uint64     `json:"id"`
+	Username      string     `json:"username"`
+	CryptPassword string     `json:"password"`
+	Email         string     `json:"email"`
+	BrandID       uint64     `json:"brand_id,omitempty"`
+	Version       uint64     `json:"version"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+type UserBrandDto struct {
+	BrandID uint64 `json:"brand_id"`
 }
 
 type UserDto struct {
@@ -41,26 +63,60 @@ type TokenDto struct {
 	Token string `json:"token"`
 }
 
+// Station.Version counts changes of the station itself, PriceVersion counts
+// recorded prices so that generated prices do not invalidate the version
+// writers send back in If-Match.
 type Station struct {
-	ID            uint64      `json:"id"`
-	Name          string      `json:"name"`
-	Address       string      `json:"address"`
-	SupportedFuel []GasType   `json:"supported_fuel"`
-	Location      Location    `json:"location"`
-	CurrentPrice  GasPrices   `json:"current_price"`
-	PricesHistory []GasPrices `json:"price_history"`
+	ID            uint64        `json:"id"`
+	Version       uint64        `json:"version"`
+	PriceVersion  uint64        `json:"-"`
+	DeletedAt     *time.Time    `json:"deleted_at,omitempty"`
+	ExternalID    string        `json:"external_id,omitempty"`
+	BrandID       uint64        `json:"brand_id,omitempty"`
+	Name          string        `json:"name"`
+	Address       string        `json:"address"`
+	SupportedFuel []GasType     `json:"supported_fuel"`
+	Location      Location      `json:"location"`
+	Regions       []string      `json:"regions"`
+	Hours         *OpeningHours `json:"opening_hours,omitempty"`
+	Amenities     []Amenity     `json:"amenities"`
+	EVConnectors  []EVConnector `json:"ev_connectors,omitempty"`
+	CurrentPrice  GasPrices     `json:"current_price"`
+	PricesHistory []GasPrices   `json:"price_history"`
+}
+
+// StationView is a station as the API returns it, with its open status at
+// the time of the request.
+type StationView struct {
+	*Station
+	Open bool `json:"open"`
+}
+
+// PriceChange is a price recorded for a station with the one it replaced.
+type PriceChange struct {
+	StationID uint64
+	Before    GasPrices
+	After     GasPrices
 }
 
 type GasPrices struct {
-	Prices map[GasType]float64 `json:"prices"`
-	Time   time.Time           `json:"time"`
+	Prices     map[GasType]float64 `json:"prices"`
+	Time       time.Time           `json:"time"`
+	Capped     []GasType           `json:"capped,omitempty"`
+	Resolution string              `json:"resolution,omitempty"`
+	Samples    int                 `json:"samples,omitempty"`
 }
 
 type StationDto struct {
+	ExternalID    string              `json:"external_id"`
+	BrandID       uint64              `json:"brand_id"`
 	Name          string              `json:"name"`
 	Address       string              `json:"address"`
 	SupportedFuel []GasType           `json:"supported_fuel"`
 	Location      Location            `json:"location"`
+	Hours         *OpeningHours       `json:"opening_hours"`
+	Amenities     []Amenity           `json:"amenities"`
+	EVConnectors  []EVConnector       `json:"ev_connectors"`
 	CurrentPrice  map[GasType]float64 `json:"prices"`
 }
 
@@ -75,6 +131,72 @@ type StationPriceLocDto struct {
 	Location     Location            `json:"location"`
 	CurrentPrice map[GasType]float64 `json:"current_price"`
 	Distance     float64             `json:"distance_km"`
+	Open         bool                `json:"open"`
+}
+
+type FuelType struct {
+	Code     GasType `json:"code"`
+	Name     string  `json:"name"`
+	Unit     string  `json:"unit"`
+	Category string  `json:"category"`
+}
+
+type FuelTypeDto struct {
+	Code     GasType `json:"code"`
+	Name     string  `json:"name"`
+	Unit     string  `json:"unit"`
+	Category string  `json:"category"`
+}
+
+type Brand struct {
+	ID         uint64 `json:"id"`
+	ExternalID string `json:"external_id,omitempty"`
+	Name       string `json:"name"`
+}
+
+type BrandDto struct {
+	ExternalID string `json:"external_id"`
+	Name       string `json:"name"`
+}
+
+type BrandPriceStatsDto struct {
+	BrandID   uint64           `json:"brand_id"`
+	BrandName string           `json:"brand_name"`
+	Stations  int              `json:"stations"`
+	Stats     []*PriceStatsDto `json:"stats"`
+}
+
+type Region struct {
+	ID       uint64          `json:"id"`
+	Code     string          `json:"code"`
+	Name     string          `json:"name"`
+	Kind     string          `json:"kind"`
+	Geometry json.RawMessage `json:"geometry"`
+	polygons []Polygon
+}
+
+type RegionDto struct {
+	Code     string          `json:"code"`
+	Name     string          `json:"name"`
+	Kind     string          `json:"kind"`
+	Geometry json.RawMessage `json:"geometry"`
+}
+
+type PriceCap struct {
+	ID        uint64    `json:"id"`
+	GasType   GasType   `json:"gas_type"`
+	MaxPrice  float64   `json:"max_price"`
+	ValidFrom time.Time `json:"valid_from"`
+	ValidTo   time.Time `json:"valid_to"`
+	Region    string    `json:"region,omitempty"`
+}
+
+type PriceCapDto struct {
+	GasType   GasType   `json:"gas_type"`
+	MaxPrice  float64   `json:"max_price"`
+	ValidFrom time.Time `json:"valid_from"`
+	ValidTo   time.Time `json:"valid_to"`
+	Region    string    `json:"region"`
 }
 
 func NewTokenDto(token string) *TokenDto {
@@ -93,6 +215,7 @@ func NewUser(id uint64, uname string, pass string, email string) (*User, error)
 		Username:      uname,
 		CryptPassword: encryPwd,
 		Email:         email,
+		Version:       1,
 	}, nil
 }
 
@@ -116,6 +239,7 @@ func NewStation(
 	histP []GasPrices) *Station {
 	return &Station{
 		ID:            id,
+		Version:       1,
 		Name:          name,
 		Address:       addr,
 		SupportedFuel: suppFuel,
@@ -125,6 +249,251 @@ func NewStation(
 	}
 }
 
+func ValidFuelUnit(u string) bool {
+	return u == "litre" ||
+		u == "kg" ||
+		u == "kWh"
+}
+
+func ValidFuelCategory(c string) bool {
+	return c == "gasoline" ||
+		c == "diesel" ||
+		c == "gas" ||
+		c == "additive" ||
+		c == "electricity"
+}
+
+func NewFuelType(dto *FuelTypeDto) (*FuelType, error) {
+	if dto.Code == "" {
+		return nil, fmt.Errorf("Fuel type code is required")
+	}
+	for _, r := range dto.Code {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '_') {
+			return nil, fmt.Errorf("Invalid fuel type code, use lowercase letters, digits and _")
+		}
+	}
+	if dto.Name == "" {
+		return nil, fmt.Errorf("Fuel type name is required")
+	}
+	if !ValidFuelUnit(dto.Unit) {
+		return nil, fmt.Errorf("Invalid fuel unit, expected litre, kg or kWh")
+	}
+	if !ValidFuelCategory(dto.Category) {
+		return nil, fmt.Errorf("Invalid fuel category, expected gasoline, diesel, gas, additive or electricity")
+	}
+	return &FuelType{
+		Code:     dto.Code,
+		Name:     dto.Name,
+		Unit:     dto.Unit,
+		Category: dto.Category,
+	}, nil
+}
+
+// DefaultFuelTypes keeps the original diesel, gasoline and gas codes so
+// existing stations stay valid, next to the grades sold in Croatia.
+func DefaultFuelTypes() []*FuelType {
+	return []*FuelType{
+		{Code: "diesel", Name: "Diesel", Unit: "litre", Category: "diesel"},
+		{Code: "gasoline", Name: "Gasoline", Unit: "litre", Category: "gasoline"},
+		{Code: "gas", Name: "Gas", Unit: "litre", Category: "gas"},
+		{Code: "eurosuper_95", Name: "Eurosuper 95", Unit: "litre", Category: "gasoline"},
+		{Code: "eurosuper_100", Name: "Eurosuper 100", Unit: "litre", Category: "gasoline"},
+		{Code: "premium_diesel", Name: "Premium diesel", Unit: "litre", Category: "diesel"},
+		{Code: "lpg", Name: "LPG", Unit: "litre", Category: "gas"},
+		{Code: "adblue", Name: "AdBlue", Unit: "litre", Category: "additive"},
+		{Code: "ev_charging", Name: "EV charging", Unit: "kWh", Category: "electricity"},
+	}
+}
+
+func NewBrand(id uint64, dto *BrandDto) (*Brand, error) {
+	if dto.Name == "" {
+		return nil, fmt.Errorf("Brand name is required")
+	}
+	return &Brand{
+		ID:         id,
+		ExternalID: dto.ExternalID,
+		Name:       dto.Name,
+	}, nil
+}
+
+func ValidRegionKind(k string) bool {
+	return k == "county" ||
+		k == "city" ||
+		k == "custom"
+}
+
+func NewRegion(id uint64, dto *RegionDto) (*Region, error) {
+	if dto.Code == "" {
+		return nil, fmt.Errorf("Region code is required")
+	}
+	if !ValidRegionKind(dto.Kind) {
+		return nil, fmt.Errorf("Invalid region kind, expected county, city or custom")
+	}
+	polygons, err := ParseGeoJSONPolygons(dto.Geometry)
+	if err != nil {
+		return nil, err
+	}
+	return &Region{
+		ID:       id,
+		Code:     dto.Code,
+		Name:     dto.Name,
+		Kind:     dto.Kind,
+		Geometry: dto.Geometry,
+		polygons: polygons,
+	}, nil
+}
+
+func (r *Region) Contains(loc *Location) bool {
+	return PolygonsContain(r.polygons, loc)
+}
+
+func NewPriceCap(id uint64, dto *PriceCapDto) (*PriceCap, error) {
+	if dto.MaxPrice <= 0 {
+		return nil, fmt.Errorf("Invalid max price, must be positive")
+	}
+	if dto.ValidFrom.IsZero() || dto.ValidTo.IsZero() {
+		return nil, fmt.Errorf("Validity window is required")
+	}
+	if !dto.ValidTo.After(dto.ValidFrom) {
+		return nil, fmt.Errorf("Invalid validity window, valid_to must be after valid_from")
+	}
+	return &PriceCap{
+		ID:        id,
+		GasType:   dto.GasType,
+		MaxPrice:  dto.MaxPrice,
+		ValidFrom: dto.ValidFrom,
+		ValidTo:   dto.ValidTo,
+		Region:    dto.Region,
+	}, nil
+}
+
+func (c *PriceCap) ActiveAt(t time.Time) bool {
+	return !t.Before(c.ValidFrom) && t.Before(c.ValidTo)
+}
+
+func (c *PriceCap) AppliesTo(gt GasType, regions []string) bool {
+	if c.GasType != gt {
+		return false
+	}
+	if c.Region == "" {
+		return true
+	}
+	for _, r := range regions {
+		if r == c.Region {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxAllowedPrice returns the lowest cap that applies to the gas type in
+// any of the regions, national caps apply everywhere.
+func MaxAllowedPrice(caps []*PriceCap, gt GasType, regions []string) (float64, bool) {
+	max := 0.0
+	found := false
+	for _, c := range caps {
+		if !c.AppliesTo(gt, regions) {
+			continue
+		}
+		if !found || c.MaxPrice < max {
+			max = c.MaxPrice
+			found = true
+		}
+	}
+	return max, found
+}
+
+func ValidatePriceCaps(caps []*PriceCap, prices map[GasType]float64, regions []string) error {
+	for gt, p := range prices {
+		if max, ok := MaxAllowedPrice(caps, gt, regions); ok && p > max {
+			return fmt.Errorf("Price %.3f for %s exceeds regulated cap of %.3f", p, gt, max)
+		}
+	}
+	return nil
+}
+
+// ClampPriceCaps lowers every price above its cap to the cap and flags the
+// gas type as capped.
+func ClampPriceCaps(caps []*PriceCap, price *GasPrices, regions []string) {
+	for _, gt := range sortedGasTypes(price.Prices) {
+		if max, ok := MaxAllowedPrice(caps, gt, regions); ok && price.Prices[gt] > max {
+			price.Prices[gt] = max
+			price.Capped = append(price.Capped, gt)
+		}
+	}
+}
+
+func (g GasPrices) Copy() GasPrices {
+	prices := make(map[GasType]float64, len(g.Prices))
+	for k, v := range g.Prices {
+		prices[k] = v
+	}
+	var capped []GasType
+	if len(g.Capped) > 0 {
+		capped = make([]GasType, len(g.Capped))
+		copy(capped, g.Capped)
+	}
+	return GasPrices{
+		Prices:     prices,
+		Time:       g.Time,
+		Capped:     capped,
+		Resolution: g.Resolution,
+		Samples:    g.Samples,
+	}
+}
+
+func (s *Station) Copy() *Station {
+	cp := *s
+	if s.DeletedAt != nil {
+		deletedAt := *s.DeletedAt
+		cp.DeletedAt = &deletedAt
+	}
+
+	cp.SupportedFuel = make([]GasType, len(s.SupportedFuel))
+	copy(cp.SupportedFuel, s.SupportedFuel)
+
+	cp.Regions = make([]string, len(s.Regions))
+	copy(cp.Regions, s.Regions)
+
+	cp.Hours = s.Hours.Copy()
+	cp.Amenities = make([]Amenity, len(s.Amenities))
+	copy(cp.Amenities, s.Amenities)
+	cp.EVConnectors = make([]EVConnector, len(s.EVConnectors))
+	copy(cp.EVConnectors, s.EVConnectors)
+	cp.CurrentPrice = s.CurrentPrice.Copy()
+	cp.PricesHistory = make([]GasPrices, len(s.PricesHistory))
+	for i, gp := range s.PricesHistory {
+		cp.PricesHistory[i] = gp.Copy()
+	}
+
+	return &cp
+}
+
+func (s *Station) Dto() *StationDto {
+	cp := s.Copy()
+	return &StationDto{
+		ExternalID:    cp.ExternalID,
+		BrandID:       cp.BrandID,
+		Name:          cp.Name,
+		Address:       cp.Address,
+		SupportedFuel: cp.SupportedFuel,
+		Location:      cp.Location,
+		Hours:         cp.Hours,
+		Amenities:     cp.Amenities,
+		EVConnectors:  cp.EVConnectors,
+		CurrentPrice:  cp.CurrentPrice.Prices,
+	}
+}
+
+func (u *User) Copy() *User {
+	cp := *u
+	if u.DeletedAt != nil {
+		deletedAt := *u.DeletedAt
+		cp.DeletedAt = &deletedAt
+	}
+	return &cp
+}
+
 func DistanceKm(aLoc, bLoc *Location) float64 {
 	lonA := aLoc.Longitude * math.Pi / 180
 	lonB := bLoc.Longitude * math.Pi / 180
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Ministry of Economy dataset lists stations (postajas) with their
+// price lists (cjenici), each price pointing at a fuel (gorivo) of the
+// station owner (obveznik). Fuels have a kind (vrsta_goriva) which in
+// turn has a fuel type (tip_goriva).
+type openDataset struct {
+	Companies []openDataCompany  `json:"obvezniks"`
+	Stations  []openDataStation  `json:"postajas"`
+	Fuels     []openDataFuel     `json:"gorivos"`
+	FuelKinds []openDataFuelKind `json:"vrsta_gorivas"`
+	FuelTypes []openDataFuelType `json:"tip_gorivas"`
+}
+
+type openDataCompany struct {
+	ID   flexInt `json:"id"`
+	Name string  `json:"naziv"`
+}
+
+type openDataStation struct {
+	ID        flexInt         `json:"id"`
+	Name      string          `json:"naziv"`
+	Address   string          `json:"adresa"`
+	Place     string          `json:"mjesto"`
+	Latitude  flexFloat       `json:"lat"`
+	Longitude flexFloat       `json:"long"`
+	CompanyID flexInt         `json:"obveznik_id"`
+	Prices    []openDataPrice `json:"cjenici"`
+}
+
+type openDataPrice struct {
+	Price  flexFloat `json:"cijena"`
+	FuelID flexInt   `json:"gorivo_id"`
+}
+
+type openDataFuel struct {
+	ID     flexInt `json:"id"`
+	Name   string  `json:"naziv"`
+	KindID flexInt `json:"vrsta_goriva_id"`
+}
+
+type openDataFuelKind struct {
+	ID     flexInt `json:"id"`
+	Name   string  `json:"vrsta_goriva"`
+	TypeID flexInt `json:"tip_goriva_id"`
+}
+
+type openDataFuelType struct {
+	ID   flexInt `json:"id"`
+	Name string  `json:"tip_goriva"`
+}
+
+// The dataset is not consistent about quoting numbers, so numeric fields
+// accept both JSON numbers and strings, with a decimal comma allowed.
+type flexFloat float64
+
+type flexInt int64
+
+func (f *flexFloat) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(strings.TrimSpace(string(b)), "\"")
+	if s == "" || s == "null" {
+		*f = 0
+		return nil
+	}
+	v, err := strconv.ParseFloat(strings.Replace(s, ",", ".", 1), 64)
+	if err != nil {
+		return fmt.Errorf("Invalid number %s", s)
+	}
+	*f = flexFloat(v)
+	return nil
+}
+
+func (i *flexInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(strings.TrimSpace(string(b)), "\"")
+	if s == "" || s == "null" {
+		*i = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid integer %s", s)
+	}
+	*i = flexInt(v)
+	return nil
+}
+
+type OpenDataImportResultDto struct {
+	Source       string              `json:"source"`
+	Total        int                 `json:"total"`
+	Created      int                 `json:"created"`
+	Updated      int                 `json:"updated"`
+	Unchanged    int                 `json:"unchanged"`
+	PriceChanges int                 `json:"price_changes"`
+	Skipped      int                 `json:"skipped"`
+	Errors       []ImportRowErrorDto `json:"errors"`
+}
+
+// openDataGasTypes maps the dataset fuel naming onto fuel catalog codes, it
+// checks the fuel kind and type names since owners name fuels freely. The
+// codes are ordered from the most specific grade to the generic fallback.
+func openDataGasTypes(names ...string) []GasType {
+	joined := strings.ToLower(strings.Join(names, " "))
+	switch {
+	case strings.Contains(joined, "adblue"):
+		return []GasType{"adblue"}
+	case strings.Contains(joined, "autoplin") ||
+		strings.Contains(joined, "lpg"):
+		return []GasType{"lpg", "gas"}
+	case strings.Contains(joined, "plin"):
+		return []GasType{"gas"}
+	case strings.Contains(joined, "dizel") ||
+		strings.Contains(joined, "diesel"):
+		if strings.Contains(joined, "premium") ||
+			strings.Contains(joined, "plus") {
+			return []GasType{"premium_diesel", "diesel"}
+		}
+		return []GasType{"diesel"}
+	case strings.Contains(joined, "100"):
+		return []GasType{"eurosuper_100", "gasoline"}
+	case strings.Contains(joined, "benzin") ||
+		strings.Contains(joined, "eurosuper") ||
+		strings.Contains(joined, "super"):
+		return []GasType{"eurosuper_95", "gasoline"}
+	}
+	return nil
+}
+
+// openDataGasType picks the first candidate code present in the catalog.
+func openDataGasType(valid func(GasType) bool, names ...string) (GasType, bool) {
+	for _, gt := range openDataGasTypes(names...) {
+		if valid(gt) {
+			return gt, true
+		}
+	}
+	return "", false
+}
+
+func ParseOpenData(r io.Reader) (*openDataset, error) {
+	dataset := new(openDataset)
+	if err := json.NewDecoder(r).Decode(dataset); err != nil {
+		return nil, fmt.Errorf("Failed to parse open data: %v", err)
+	}
+	return dataset, nil
+}
+
+// StationRows maps every dataset station onto a StationDto keyed by the
+// dataset id, rows are numbered from 1 in dataset order. When several
+// fuels of a station map onto the same gas type the cheapest one is used,
+// which is the regular grade. Fuels are mapped onto the codes valid
+// accepts and station owners onto brands.
+func (d *openDataset) StationRows(valid func(GasType) bool, brands map[flexInt]uint64) []*ImportRow {
+	kinds := make(map[flexInt]openDataFuelKind)
+	for _, k := range d.FuelKinds {
+		kinds[k.ID] = k
+	}
+	types := make(map[flexInt]string)
+	for _, t := range d.FuelTypes {
+		types[t.ID] = t.Name
+	}
+	fuels := make(map[flexInt]GasType)
+	for _, f := range d.Fuels {
+		kind := kinds[f.KindID]
+		if gt, ok := openDataGasType(valid, f.Name, kind.Name, types[kind.TypeID]); ok {
+			fuels[f.ID] = gt
+		}
+	}
+
+	rows := make([]*ImportRow, 0, len(d.Stations))
+	for i, st := range d.Stations {
+		if st.ID == 0 {
+			rows = append(rows, &ImportRow{Row: i + 1, Err: fmt.Errorf("Missing station id")})
+			continue
+		}
+		if st.Latitude == 0 && st.Longitude == 0 {
+			rows = append(rows, &ImportRow{Row: i + 1, Err: fmt.Errorf("Missing coordinates")})
+			continue
+		}
+
+		prices := make(map[GasType]float64)
+		for _, p := range st.Prices {
+			gt, ok := fuels[p.FuelID]
+			if !ok || p.Price <= 0 {
+				continue
+			}
+			if cur, ok := prices[gt]; !ok || float64(p.Price) < cur {
+				prices[gt] = float64(p.Price)
+			}
+		}
+
+		suppFuel := make([]GasType, 0, len(prices))
+		for gt := range prices {
+			suppFuel = append(suppFuel, gt)
+		}
+		sort.Slice(suppFuel, func(i, j int) bool {
+			return suppFuel[i] < suppFuel[j]
+		})
+
+		address := st.Address
+		if st.Place != "" {
+			address = strings.TrimSpace(address + ", " + st.Place)
+		}
+
+		rows = append(rows, &ImportRow{Row: i + 1, Station: &StationDto{
+			ExternalID:    "mingor:" + strconv.FormatInt(int64(st.ID), 10),
+			BrandID:       brands[st.CompanyID],
+			Name:          st.Name,
+			Address:       address,
+			SupportedFuel: suppFuel,
+			Location: Location{
+				Latitude:  float64(st.Latitude),
+				Longitude: float64(st.Longitude),
+			},
+			CurrentPrice: prices,
+		}})
+	}
+	return rows
+}
+
+// ImportOpenData upserts the dataset stations and records an audit entry of
+// every created and updated station for actor.
+func ImportOpenData(storage Storage, audit AuditStore, actor, ip string, r io.Reader, source string) (*OpenDataImportResultDto, error) {
+	dataset, err := ParseOpenData(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &OpenDataImportResultDto{
+		Source: source,
+		Total:  len(dataset.Stations),
+		Errors: make([]ImportRowErrorDto, 0),
+	}
+
+	brands := make(map[flexInt]uint64)
+	for _, c := range dataset.Companies {
+		if c.ID == 0 || c.Name == "" {
+			continue
+		}
+		brand, err := storage.UpsertBrandByExternalID(&BrandDto{
+			ExternalID: "mingor:" + strconv.FormatInt(int64(c.ID), 10),
+			Name:       c.Name,
+		})
+		if err != nil {
+			result.Errors = append(result.Errors, ImportRowErrorDto{Error: fmt.Sprintf("Company %d: %v", c.ID, err)})
+			continue
+		}
+		brands[c.ID] = brand.ID
+	}
+
+	for _, row := range dataset.StationRows(storage.ValidFuelType, brands) {
+		if row.Err == nil {
+			row.Err = ValidateStationDto(storage, row.Station)
+		}
+		if row.Err != nil {
+			result.Errors = append(result.Errors, ImportRowErrorDto{Row: row.Row, Error: row.Err.Error()})
+			result.Skipped++
+			continue
+		}
+
+		before, after, err := storage.UpsertStationByExternalID(row.Station)
+		if errors.Is(err, ErrStationDeleted) {
+			result.Skipped++
+			continue
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, ImportRowErrorDto{Row: row.Row, Error: fmt.Sprintf("%s: %v", row.Station.ExternalID, err)})
+			result.Skipped++
+			continue
+		}
+		if before == nil {
+			writeAudit(audit, actor, ip, AuditImport, "station", after.ID, nil, after.Dto())
+			result.Created++
+			continue
+		}
+		if after.Version == before.Version {
+			result.Unchanged++
+			continue
+		}
+		writeAudit(audit, actor, ip, AuditUpdate, "station", after.ID, before.Dto(), after.Dto())
+		result.Updated++
+		if !pricesEqual(before.CurrentPrice.Prices, after.CurrentPrice.Prices) {
+			result.PriceChanges++
+		}
+	}
+	return result, nil
+}
+
+// maxOpenDataSize limits the downloaded dataset, the full national dataset
+// is a few megabytes.
+const maxOpenDataSize = 64 << 20
+
+type OpenDataImporter struct {
+	storage Storage
+	audit   AuditStore
+	url     string
+	client  *http.Client
+	maxSize int64
+}
+
+func NewOpenDataImporter(storage Storage, audit AuditStore, url string, client *http.Client) *OpenDataImporter {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &OpenDataImporter{
+		storage: storage,
+		audit:   audit,
+		url:     url,
+		client:  client,
+		maxSize: maxOpenDataSize,
+	}
+}
+
+// ImportFile imports the dataset at path on behalf of the system.
+func (o *OpenDataImporter) ImportFile(path string) (*OpenDataImportResultDto, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ImportOpenData(o.storage, o.audit, AuditSystemActor, "", f, path)
+}
+
+// ImportURL downloads the dataset from the configured URL on behalf of
+// actor. Requests never choose the URL, so the server fetches nothing but
+// the dataset.
+func (o *OpenDataImporter) ImportURL(actor, ip string) (*OpenDataImportResultDto, error) {
+	if o.url == "" {
+		return nil, fmt.Errorf("Open data URL is not configured")
+	}
+
+	resp, err := o.client.Get(o.url)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch open data: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch open data, status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, o.maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch open data: %v", err)
+	}
+	if int64(len(body)) > o.maxSize {
+		return nil, fmt.Errorf("Open data is larger than %d bytes", o.maxSize)
+	}
+	return ImportOpenData(o.storage, o.audit, actor, ip, bytes.NewReader(body), o.url)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const openDataFixture = `{
+	"obvezniks": [{"id": 1, "naziv": "Petrol"}],
+	"postajas": [
+		{"id": 10, "naziv": "Zagreb", "adresa": "Ilica 1", "mjesto": "Zagreb", "lat": "45,81", "long": "15,97", "obveznik_id": 1,
+			"cjenici": [{"cijena": "1,45", "gorivo_id": 1}]},
+		{"id": 11, "naziv": "Split", "adresa": "Riva 1", "mjesto": "Split", "lat": 43.51, "long": 16.44, "obveznik_id": 1,
+			"cjenici": [{"cijena": 1.75, "gorivo_id": 1}]},
+		{"id": 12, "naziv": "Nowhere", "obveznik_id": 1, "cjenici": []}
+	],
+	"gorivos": [{"id": 1, "naziv": "Eurodiesel", "vrsta_goriva_id": 1}],
+	"vrsta_gorivas": [{"id": 1, "vrsta_goriva": "Dizel", "tip_goriva_id": 1}],
+	"tip_gorivas": [{"id": 1, "tip_goriva": "Dizel"}]
+}`
+
+// newOpenDataTest serves the fixture and returns the API server importing
+// it together with the number of dataset downloads.
+func newOpenDataTest(t *testing.T) (*APIServer, *RAMStorage, *int32) {
+	t.Helper()
+	var hits int32
+	dataset := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		fmt.Fprint(w, openDataFixture)
+	}))
+	t.Cleanup(dataset.Close)
+
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, _ := newTestStorage(t, NewSimConfig(clock, 7))
+	audit := NewRAMAuditStore(clock)
+	server := &APIServer{
+		storage:  storage,
+		audit:    audit,
+		openData: NewOpenDataImporter(storage, audit, dataset.URL, dataset.Client()),
+	}
+	return server, storage, &hits
+}
+
+func importOpenData(t *testing.T, server *APIServer, target string) (*httptest.ResponseRecorder, *OpenDataImportResultDto) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	wrapApiHandleFunc(server.handleImportOpenData)(w, httptest.NewRequest(http.MethodPost, target, nil))
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+	result := new(OpenDataImportResultDto)
+	if err := json.NewDecoder(w.Body).Decode(result); err != nil {
+		t.Fatal(err)
+	}
+	return w, result
+}
+
+func TestImportOpenDataIgnoresRequestURL(t *testing.T) {
+	server, _, hits := newOpenDataTest(t)
+
+	var otherHits int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&otherHits, 1)
+	}))
+	defer other.Close()
+
+	w, _ := importOpenData(t, server, "/admin/import/opendata?url="+other.URL)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Import failed with %d: %s", w.Code, w.Body)
+	}
+	if atomic.LoadInt32(&otherHits) != 0 {
+		t.Fatal("Import fetched the URL from the request")
+	}
+	if atomic.LoadInt32(hits) != 1 {
+		t.Fatalf("Configured URL was fetched %d times", atomic.LoadInt32(hits))
+	}
+}
+
+func TestImportOpenDataLimitsBodySize(t *testing.T) {
+	server, storage, _ := newOpenDataTest(t)
+	server.openData.maxSize = 64
+
+	w, _ := importOpenData(t, server, "/admin/import/opendata")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Oversized dataset got %d: %s", w.Code, w.Body)
+	}
+	stations, err := storage.GetStations(&StationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stations) != 0 {
+		t.Fatalf("Oversized dataset imported %d stations", len(stations))
+	}
+}
+
+func TestImportOpenDataValidatesRows(t *testing.T) {
+	server, storage, _ := newOpenDataTest(t)
+	_, err := storage.CreatePriceCap(&PriceCapDto{
+		GasType:   "diesel",
+		MaxPrice:  1.50,
+		ValidFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		ValidTo:   time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, result := importOpenData(t, server, "/admin/import/opendata")
+	if result == nil {
+		t.Fatal("Import failed")
+	}
+	if result.Created != 1 || result.Skipped != 2 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+	rows := make([]int, 0)
+	for _, e := range result.Errors {
+		rows = append(rows, e.Row)
+	}
+	if len(rows) != 2 || rows[0] != 2 || rows[1] != 3 {
+		t.Fatalf("Errors reported rows %v, want [2 3]: %+v", rows, result.Errors)
+	}
+}
+
+func TestImportOpenDataSkipsUnchangedAndDeletedStations(t *testing.T) {
+	server, storage, _ := newOpenDataTest(t)
+	if _, result := importOpenData(t, server, "/admin/import/opendata"); result == nil || result.Created != 2 {
+		t.Fatalf("First import failed: %+v", result)
+	}
+
+	stations, err := storage.GetStations(&StationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := make(map[uint64]uint64)
+	for _, st := range stations {
+		versions[st.ID] = st.Version
+		if st.ExternalID == "mingor:11" {
+			if _, err := storage.DeleteStation(st.ID, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	entries, err := server.audit.GetAuditEntries(&AuditFilter{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, result := importOpenData(t, server, "/admin/import/opendata")
+	if result == nil {
+		t.Fatal("Second import failed")
+	}
+	if result.Updated != 0 || result.Unchanged != 1 || result.Skipped != 2 || len(result.Errors) != 1 || result.Errors[0].Row != 3 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+
+	stations, err = storage.GetStations(&StationFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stations) != 1 || stations[0].Version != versions[stations[0].ID] {
+		t.Fatalf("Reimport changed the stations: %+v", stations)
+	}
+	after, err := server.audit.GetAuditEntries(&AuditFilter{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Total != entries.Total {
+		t.Fatalf("Reimport recorded %d audit entries", after.Total-entries.Total)
+	}
+}
+
+func TestImportOpenDataAuditsChanges(t *testing.T) {
+	server, _, _ := newOpenDataTest(t)
+	if _, result := importOpenData(t, server, "/admin/import/opendata"); result == nil || result.Created != 2 {
+		t.Fatalf("Import failed: %+v", result)
+	}
+
+	page, err := server.audit.GetAuditEntries(&AuditFilter{Resource: "station", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 {
+		t.Fatalf("Recorded %d audit entries, want 2", page.Total)
+	}
+	for _, e := range page.Entries {
+		if e.Action != AuditImport || len(e.Changes) == 0 {
+			t.Fatalf("Unexpected audit entry %+v", e)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// busMessage is the payload published on Redis, the origin lets an
+// instance skip its own events when Redis echoes them back.
+type busMessage struct {
+	Origin string      `json:"origin"`
+	Event  *PriceEvent `json:"event"`
+}
+
+const (
+	// redisPublishQueue bounds the events waiting to be published on
+	// Redis, more are dropped while Redis is slow or unreachable.
+	redisPublishQueue = 1024
+	// redisDeliverQueue bounds the remote events waiting for the local
+	// subscribers, more are dropped while they fall behind.
+	redisDeliverQueue = 1024
+	// redisPingInterval keeps the subscription checked, one that stays
+	// silent for two intervals is reconnected.
+	redisPingInterval = 5 * time.Second
+)
+
+type redisMessage struct {
+	channel string
+	payload string
+}
+
+type remoteEvent struct {
+	topic string
+	event *PriceEvent
+}
+
+// StationResolver returns the local id of the station with the external
+// id, false when this instance does not have the station.
+type StationResolver func(externalID string) (uint64, bool)
+
+// RedisBroker shares topics between instances over Redis pub/sub. Local
+// subscribers are served by a MemoryBroker, events of the replicated
+// topics are also published on Redis and events published by the other
+// instances are handed to the local subscribers. Station ids differ
+// between instances, so only events of stations with an external id are
+// shared and they are delivered under the local id the resolver gives.
+// Events the instance received itself are not Shared and never published
+// again, so replicas do not echo each other.
+// Pub/sub does not store messages, events published while an instance is
+// disconnected are lost for it.
+type RedisBroker struct {
+	local        *MemoryBroker
+	addr         string
+	prefix       string
+	origin       string
+	topics       map[string]bool
+	resolve      StationResolver
+	queue        chan redisMessage
+	inbox        chan remoteEvent
+	pingInterval time.Duration
+	pub          *respConn
+	mu           sync.Mutex
+}
+
+func NewRedisBroker(addr, prefix, origin string, topics []string) *RedisBroker {
+	b := &RedisBroker{
+		local:        NewMemoryBroker(),
+		addr:         addr,
+		prefix:       prefix,
+		origin:       origin,
+		topics:       make(map[string]bool),
+		queue:        make(chan redisMessage, redisPublishQueue),
+		inbox:        make(chan remoteEvent, redisDeliverQueue),
+		pingInterval: redisPingInterval,
+	}
+	for _, t := range topics {
+		b.topics[t] = true
+	}
+	return b
+}
+
+// SetStationResolver sets how remote events find their local station, no
+// remote event is delivered until it is set.
+func (b *RedisBroker) SetStationResolver(resolve StationResolver) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.resolve = resolve
+}
+
+func (b *RedisBroker) Subscribe(topic string, opts SubscribeOptions) (*Subscription, error) {
+	return b.local.Subscribe(topic, opts)
+}
+
+func (b *RedisBroker) Unsubscribe(sub *Subscription) error {
+	return b.local.Unsubscribe(sub)
+}
+
+func (b *RedisBroker) Stats() []*TopicStatsDto {
+	return b.local.Stats()
+}
+
+// Publish delivers the event locally first and queues it for Redis, the
+// publisher never waits for Redis. Events that do not fit in the queue are
+// dropped and logged, the local instance still works.
+func (b *RedisBroker) Publish(ctx context.Context, topic string, event *PriceEvent) error {
+	if err := b.local.Publish(ctx, topic, event); err != nil {
+		return err
+	}
+	if !b.topics[topic] || !event.Shared || event.ExternalID == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(&busMessage{Origin: b.origin, Event: event})
+	if err != nil {
+		return err
+	}
+	select {
+	case b.queue <- redisMessage{channel: b.prefix + topic, payload: string(payload)}:
+	default:
+		log.Printf("Dropping event of station %d, the queue to %s is full", event.StationID, b.addr)
+	}
+	return nil
+}
+
+// publishQueued publishes the queued events until ctx ends.
+func (b *RedisBroker) publishQueued(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-b.queue:
+			if err := b.publishRemote(m.channel, m.payload); err != nil {
+				log.Printf("Failed to publish on %s: %v", b.addr, err)
+			}
+		}
+	}
+}
+
+func (b *RedisBroker) publishRemote(channel, payload string) error {
+	if b.pub == nil {
+		conn, err := dialRESP(b.addr)
+		if err != nil {
+			return err
+		}
+		b.pub = conn
+	}
+	b.pub.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.pub.Do("PUBLISH", channel, payload); err != nil {
+		b.pub.Close()
+		b.pub = nil
+		return err
+	}
+	return nil
+}
+
+// Run publishes the queued events and receives the events of the other
+// instances until ctx ends, it reconnects when a connection drops. Remote
+// events are delivered to the local subscribers from their own queue, so
+// a slow subscriber never stalls the subscription.
+func (b *RedisBroker) Run(ctx context.Context) {
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		b.publishQueued(ctx)
+	}()
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		b.deliverQueued(ctx)
+	}()
+
+	for ctx.Err() == nil {
+		if err := b.receive(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Lost broker connection to %s: %v", b.addr, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+
+	<-published
+	<-delivered
+	if b.pub != nil {
+		b.pub.Close()
+		b.pub = nil
+	}
+}
+
+func (b *RedisBroker) receive(ctx context.Context) error {
+	conn, err := dialRESP(b.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	channels := make([]string, 0, len(b.topics))
+	for t := range b.topics {
+		channels = append(channels, b.prefix+t)
+	}
+	if err := conn.Send(append([]string{"SUBSCRIBE"}, channels...)...); err != nil {
+		return err
+	}
+
+	// Only the pings write from now on, replies arrive as pushed pongs.
+	pinged := make(chan struct{})
+	defer close(pinged)
+	go func() {
+		ticker := time.NewTicker(b.pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pinged:
+				return
+			case <-ticker.C:
+			}
+			conn.conn.SetWriteDeadline(time.Now().Add(b.pingInterval))
+			if err := conn.Send("PING"); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		conn.conn.SetReadDeadline(time.Now().Add(2 * b.pingInterval))
+		reply, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		if e, ok := reply.(respError); ok {
+			return e
+		}
+		msg, ok := respStrings(reply)
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		b.deliverRemote(msg[1], msg[2])
+	}
+}
+
+// deliverRemote queues the event of another instance for the local
+// subscribers under the local id of its station.
+func (b *RedisBroker) deliverRemote(channel, payload string) {
+	topic, ok := strings.CutPrefix(channel, b.prefix)
+	if !ok || !b.topics[topic] {
+		return
+	}
+
+	msg := new(busMessage)
+	if err := json.Unmarshal([]byte(payload), msg); err != nil {
+		log.Printf("Skipping invalid message on %s: %v", channel, err)
+		return
+	}
+	if msg.Event == nil || msg.Origin == b.origin || msg.Event.ExternalID == "" {
+		return
+	}
+
+	b.mu.Lock()
+	resolve := b.resolve
+	b.mu.Unlock()
+	if resolve == nil {
+		return
+	}
+	id, ok := resolve(msg.Event.ExternalID)
+	if !ok {
+		return
+	}
+	msg.Event.StationID = id
+	// Prices recorded on another instance are handed to the receiver of
+	// the station like generated ones, so they end up in the local storage
+	// and event log too.
+	if topic == TopicPriceRecorded {
+		topic = TopicPriceGenerated
+	}
+	select {
+	case b.inbox <- remoteEvent{topic: topic, event: msg.Event}:
+	default:
+		log.Printf("Dropping remote event of station %d, its subscribers fell behind", id)
+	}
+}
+
+// deliverQueued publishes the remote events locally until ctx ends.
+func (b *RedisBroker) deliverQueued(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-b.inbox:
+			if err := b.local.Publish(ctx, e.topic, e.event); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRedisBrokerDeliversRemoteEventsByExternalID(t *testing.T) {
+	b := NewRedisBroker("127.0.0.1:0", "test:", "a", []string{TopicPriceGenerated})
+	b.SetStationResolver(func(externalID string) (uint64, bool) {
+		if externalID == "mingor:10" {
+			return 7, true
+		}
+		return 0, false
+	})
+	sub, err := b.Subscribe(TopicPriceGenerated, SubscribeOptions{Buffer: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.deliverQueued(ctx)
+
+	deliver := func(origin string, event *PriceEvent) {
+		payload, err := json.Marshal(&busMessage{Origin: origin, Event: event})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.deliverRemote("test:"+TopicPriceGenerated, string(payload))
+	}
+	prices := map[GasType]float64{"diesel": 1.4}
+	deliver("b", &PriceEvent{StationID: 99, ExternalID: "mingor:10", Prices: prices})
+	deliver("b", &PriceEvent{StationID: 7, Prices: prices})
+	deliver("b", &PriceEvent{StationID: 98, ExternalID: "mingor:11", Prices: prices})
+	deliver("a", &PriceEvent{StationID: 7, ExternalID: "mingor:10", Prices: prices})
+
+	select {
+	case e := <-sub.C:
+		if e.StationID != 7 {
+			t.Fatalf("Remote event delivered to station %d, want the local id 7", e.StationID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Remote event was not delivered")
+	}
+	select {
+	case e := <-sub.C:
+		t.Fatalf("Unexpected event %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRedisBrokersExchangeEventsOverRESP(t *testing.T) {
+	srv, err := NewRESPServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve()
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Both instances know the shared station under their own local id.
+	newBroker := func(origin string, localID uint64) (*RedisBroker, *Subscription) {
+		b := NewRedisBroker(srv.Addr(), "test:", origin, []string{TopicPriceGenerated})
+		b.pingInterval = 50 * time.Millisecond
+		b.SetStationResolver(func(externalID string) (uint64, bool) {
+			return localID, externalID == "mingor:10"
+		})
+		sub, err := b.Subscribe(TopicPriceGenerated, SubscribeOptions{Buffer: 64})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go b.Run(ctx)
+		return b, sub
+	}
+	a, subA := newBroker("a", 1)
+	b, subB := newBroker("b", 2)
+
+	// exchange publishes from one broker until the other one receives it,
+	// the subscriptions come up asynchronously. It returns the publishes.
+	exchange := func(from *RedisBroker, fromID uint64, to *Subscription, toID uint64) int {
+		prices := map[GasType]float64{"diesel": 1.4}
+		deadline := time.After(5 * time.Second)
+		for published := 1; ; published++ {
+			event := &PriceEvent{StationID: fromID, ExternalID: "mingor:10", Prices: prices, Shared: true}
+			if err := from.Publish(ctx, TopicPriceGenerated, event); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case e := <-to.C:
+				if e.StationID != toID {
+					t.Fatalf("Remote event delivered to station %d, want %d", e.StationID, toID)
+				}
+				return published
+			case <-time.After(100 * time.Millisecond):
+			case <-deadline:
+				t.Fatal("Remote event was not delivered")
+			}
+		}
+	}
+	// drain counts the events of sub until it stays quiet.
+	drain := func(sub *Subscription, id uint64) int {
+		n := 0
+		for {
+			select {
+			case e := <-sub.C:
+				if e.StationID != id {
+					t.Fatalf("Unexpected event %+v", e)
+				}
+				n++
+			case <-time.After(300 * time.Millisecond):
+				return n
+			}
+		}
+	}
+
+	fromA := exchange(a, 1, subB, 2)
+	if n := drain(subA, 1); n != fromA {
+		t.Fatalf("Broker a got %d events for its %d publishes, its echoes were delivered", n, fromA)
+	}
+	drain(subB, 2)
+
+	// Outlive a few read deadlines, the pings keep the subscriptions up.
+	time.Sleep(200 * time.Millisecond)
+	fromB := exchange(b, 2, subA, 1)
+	if n := drain(subB, 2); n != fromB {
+		t.Fatalf("Broker b got %d events for its %d publishes, its echoes were delivered", n, fromB)
+	}
+}
+
+func TestRedisBrokerSlowSubscriberDoesNotBlockReceiving(t *testing.T) {
+	b := NewRedisBroker("127.0.0.1:0", "test:", "a", []string{TopicPriceGenerated})
+	b.SetStationResolver(func(externalID string) (uint64, bool) {
+		return 7, true
+	})
+	// Never read, the local delivery blocks on the first event.
+	if _, err := b.Subscribe(TopicPriceGenerated, SubscribeOptions{Buffer: 1, Policy: OverflowBlock}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.deliverQueued(ctx)
+
+	payload, err := json.Marshal(&busMessage{Origin: "b", Event: &PriceEvent{ExternalID: "mingor:10"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2*redisDeliverQueue; i++ {
+			b.deliverRemote("test:"+TopicPriceGenerated, string(payload))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Receiving waited for a slow subscriber")
+	}
+}
+
+func TestRedisBrokerReplicatesRecordedPrices(t *testing.T) {
+	srv := newTestRESPServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Both replicas have the shared station with its generator on standby,
+	// b has to record what is submitted on a.
+	newReplica := func(origin string) (*RedisBroker, *RAMStorage, *StationView) {
+		clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+		sim := NewSimConfig(clock, 7)
+		b := NewRedisBroker(srv.Addr(), "test:", origin, []string{TopicPriceGenerated, TopicPriceRecorded})
+		b.pingInterval = 50 * time.Millisecond
+		supervisor := NewGeneratorSupervisor(sim.Clock, b)
+		t.Cleanup(func() { supervisor.Shutdown(context.Background()) })
+		supervisor.SetActive(false)
+		events := NewEventLog(1000)
+		storage := NewRAMStorage(sim, supervisor, NewMarket(sim), events)
+		b.SetStationResolver(storage.StationIDByExternalID)
+		go b.Run(ctx)
+		go events.Forward(ctx, b)
+
+		dto := testStationDto("Zagreb", 45.81, 15.97)
+		dto.ExternalID = "mingor:10"
+		st, err := storage.CreateStation(dto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		view, err := storage.GetStationByID(st.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, storage, view
+	}
+	_, storageA, stationA := newReplica("a")
+	_, storageB, stationB := newReplica("b")
+
+	// Submit until b records it, its subscription comes up asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for price := 1.30; ; price -= 0.01 {
+		submitted := map[GasType]float64{"diesel": price, "gasoline": 1.52}
+		if _, _, err := storageA.SubmitPrices(stationA.ID, 0, submitted); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		current, err := storageB.GetCurrentPrice(stationB.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.Prices["diesel"] < 1.31 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Submitted price was not recorded on the other replica")
+		}
+	}
+
+	// Neither replica records the price back from the other one.
+	time.Sleep(300 * time.Millisecond)
+	for name, storage := range map[string]*RAMStorage{"a": storageA, "b": storageB} {
+		id := stationA.ID
+		if name == "b" {
+			id = stationB.ID
+		}
+		history, err := storage.GetHistoryPrices(id, "diesel", time.Time{}, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[float64]bool)
+		for _, p := range history {
+			if p.Price > 1.30 {
+				continue
+			}
+			if seen[p.Price] {
+				t.Fatalf("Replica %s recorded %.2f twice: %+v", name, p.Price, history)
+			}
+			seen[p.Price] = true
+		}
+	}
+}
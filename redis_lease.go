@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisLeaseStore keeps leases as Redis keys expiring with the lease. The
+// holder is checked and the key written in one WATCH/MULTI/EXEC
+// transaction, so a lease taken over meanwhile is never overwritten.
+type RedisLeaseStore struct {
+	addr   string
+	prefix string
+	conn   *respConn
+	mu     sync.Mutex
+}
+
+func NewRedisLeaseStore(addr, prefix string) *RedisLeaseStore {
+	return &RedisLeaseStore{
+		addr:   addr,
+		prefix: prefix,
+	}
+}
+
+// do runs fn on the shared connection, which is dropped after any error
+// other than a held lease since it may be left inside a transaction.
+func (s *RedisLeaseStore) do(fn func(*respConn) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		conn, err := dialRESP(s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err := fn(s.conn)
+	if err != nil && !errors.Is(err, ErrLeaseHeld) {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *RedisLeaseStore) key(name string) string {
+	return s.prefix + "lease:" + name
+}
+
+func getRedisLease(c *respConn, key string) (*Lease, error) {
+	reply, err := c.Do("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, errors.New("Unexpected reply to GET")
+	}
+	lease := new(Lease)
+	if err := json.Unmarshal([]byte(value), lease); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// commitRedisLease runs the command in a transaction on the watched key, a
+// nil reply means the key changed since WATCH.
+func commitRedisLease(c *respConn, args ...string) error {
+	if _, err := c.Do("MULTI"); err != nil {
+		return err
+	}
+	if _, err := c.Do(args...); err != nil {
+		return err
+	}
+	reply, err := c.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return ErrLeaseHeld
+	}
+	return nil
+}
+
+func (s *RedisLeaseStore) AcquireLease(name, holder string, ttl time.Duration) (*Lease, error) {
+	key := s.key(name)
+	var acquired *Lease
+	err := s.do(func(c *respConn) error {
+		if _, err := c.Do("WATCH", key); err != nil {
+			return err
+		}
+		lease, err := getRedisLease(c, key)
+		if err != nil {
+			return err
+		}
+		if lease != nil && lease.Holder != holder {
+			if _, err := c.Do("UNWATCH"); err != nil {
+				return err
+			}
+			return ErrLeaseHeld
+		}
+
+		now := time.Now()
+		acquired = &Lease{
+			Name:       name,
+			Holder:     holder,
+			AcquiredAt: now,
+			ExpiresAt:  now.Add(ttl),
+		}
+		if lease != nil {
+			acquired.AcquiredAt = lease.AcquiredAt
+		}
+		value, err := json.Marshal(acquired)
+		if err != nil {
+			return err
+		}
+		return commitRedisLease(c, "SET", key, string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return acquired, nil
+}
+
+func (s *RedisLeaseStore) ReleaseLease(name, holder string) error {
+	key := s.key(name)
+	return s.do(func(c *respConn) error {
+		if _, err := c.Do("WATCH", key); err != nil {
+			return err
+		}
+		lease, err := getRedisLease(c, key)
+		if err != nil {
+			return err
+		}
+		if lease == nil || lease.Holder != holder {
+			if _, err := c.Do("UNWATCH"); err != nil {
+				return err
+			}
+			if lease == nil {
+				return nil
+			}
+			return ErrLeaseHeld
+		}
+		return commitRedisLease(c, "DEL", key)
+	})
+}
+
+func (s *RedisLeaseStore) GetLease(name string) (*Lease, error) {
+	var lease *Lease
+	err := s.do(func(c *respConn) error {
+		var err error
+		lease, err = getRedisLease(c, s.key(name))
+		return err
+	})
+	return lease, err
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ReplayPoint struct {
+	Station string
+	GasType GasType
+	Price   float64
+	Time    time.Time
+}
+
+type replayPointDto struct {
+	Station   json.RawMessage `json:"station"`
+	Fuel      GasType         `json:"fuel"`
+	Price     float64         `json:"price"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// ReplayTimeline holds a recorded price history grouped by station. The
+// station column may hold either the station id or its name.
+type ReplayTimeline struct {
+	points map[string][]ReplayPoint
+}
+
+type ReplayConfig struct {
+	Timeline *ReplayTimeline
+	Speed    float64
+	Loop     bool
+}
+
+func NewReplayTimeline(points []ReplayPoint) *ReplayTimeline {
+	byStation := make(map[string][]ReplayPoint)
+	for _, p := range points {
+		byStation[p.Station] = append(byStation[p.Station], p)
+	}
+	for _, ps := range byStation {
+		sort.SliceStable(ps, func(i, j int) bool {
+			return ps[i].Time.Before(ps[j].Time)
+		})
+	}
+	return &ReplayTimeline{
+		points: byStation,
+	}
+}
+
+func LoadReplayTimeline(path string) (*ReplayTimeline, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var points []ReplayPoint
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		points, err = ParseReplayCSV(f)
+	case ".jsonl", ".ndjson":
+		points, err = ParseReplayJSONL(f)
+	default:
+		return nil, fmt.Errorf("Unsupported replay file format, expected .csv or .jsonl")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return NewReplayTimeline(points), nil
+}
+
+func ParseReplayCSV(r io.Reader) ([]ReplayPoint, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read replay header: %v", err)
+	}
+	cols := make(map[string]int)
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	for _, c := range []string{"station", "fuel", "price", "timestamp"} {
+		if _, ok := cols[c]; !ok {
+			return nil, fmt.Errorf("Replay file is missing column %s", c)
+		}
+	}
+
+	points := make([]ReplayPoint, 0)
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read replay line %d: %v", line, err)
+		}
+
+		price, err := strconv.ParseFloat(record[cols["price"]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid price on replay line %d", line)
+		}
+		ts, err := time.Parse(time.RFC3339, record[cols["timestamp"]])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid timestamp on replay line %d", line)
+		}
+		p, err := newReplayPoint(record[cols["station"]], GasType(record[cols["fuel"]]), price, ts)
+		if err != nil {
+			return nil, fmt.Errorf("%v on replay line %d", err, line)
+		}
+		points = append(points, p)
+	}
+
+	return points, nil
+}
+
+func ParseReplayJSONL(r io.Reader) ([]ReplayPoint, error) {
+	scanner := bufio.NewScanner(r)
+	points := make([]ReplayPoint, 0)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		dto := new(replayPointDto)
+		if err := json.Unmarshal([]byte(text), dto); err != nil {
+			return nil, fmt.Errorf("Failed to parse replay line %d: %v", line, err)
+		}
+
+		station := string(dto.Station)
+		if strings.HasPrefix(station, "\"") {
+			if err := json.Unmarshal(dto.Station, &station); err != nil {
+				return nil, fmt.Errorf("Invalid station on replay line %d", line)
+			}
+		}
+		p, err := newReplayPoint(station, dto.Fuel, dto.Price, dto.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("%v on replay line %d", err, line)
+		}
+		points = append(points, p)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+func newReplayPoint(station string, gt GasType, price float64, ts time.Time) (ReplayPoint, error) {
+	station = strings.TrimSpace(station)
+	if station == "" {
+		return ReplayPoint{}, fmt.Errorf("Missing station")
+	}
+	if gt == "" {
+		return ReplayPoint{}, fmt.Errorf("Missing fuel type")
+	}
+	if price < 0 {
+		return ReplayPoint{}, fmt.Errorf("Invalid price, has negative value")
+	}
+	if ts.IsZero() {
+		return ReplayPoint{}, fmt.Errorf("Missing timestamp")
+	}
+	return ReplayPoint{
+		Station: station,
+		GasType: gt,
+		Price:   price,
+		Time:    ts,
+	}, nil
+}
+
+// ForStation returns the recorded points of the station, keeping only the
+// fuels it supports.
+func (t *ReplayTimeline) ForStation(id uint64, name string, suppFuel []GasType) []ReplayPoint {
+	ps, ok := t.points[strconv.FormatUint(id, 10)]
+	if !ok {
+		ps = t.points[name]
+	}
+
+	points := make([]ReplayPoint, 0, len(ps))
+	for _, p := range ps {
+		for _, f := range suppFuel {
+			if p.GasType == f {
+				points = append(points, p)
+				break
+			}
+		}
+	}
+	return points
+}
+
+type replayFrame struct {
+	offset time.Duration
+	prices map[GasType]float64
+}
+
+// ReplayPriceGen plays a recorded timeline back in place of a simulation.
+// Recorded gaps are divided by speed, and prices are sent with the clock's
+// time so the station history stays ordered when the timeline loops. The
+// position is kept across SendPrice calls, so a paused generator resumes
+// with the frame it was waiting for.
+type ReplayPriceGen struct {
+	frames      []replayFrame
+	priceSource PriceSource
+	clock       Clock
+	speed       float64
+	loop        bool
+	next        int
+	prevOffset  time.Duration
+}
+
+func NewReplayPriceGen(points []ReplayPoint, ps PriceSource, clock Clock, speed float64, loop bool) *ReplayPriceGen {
+	if speed <= 0 {
+		speed = 1
+	}
+
+	frames := make([]replayFrame, 0)
+	for _, p := range points {
+		offset := p.Time.Sub(points[0].Time)
+		if len(frames) == 0 || frames[len(frames)-1].offset != offset {
+			frames = append(frames, replayFrame{
+				offset: offset,
+				prices: make(map[GasType]float64),
+			})
+		}
+		frames[len(frames)-1].prices[p.GasType] = p.Price
+	}
+
+	return &ReplayPriceGen{
+		frames:      frames,
+		priceSource: ps,
+		clock:       clock,
+		speed:       speed,
+		loop:        loop,
+	}
+}
+
+func (rg *ReplayPriceGen) ModifyPrice(num float64) float64 {
+	return num
+}
+
+func (rg *ReplayPriceGen) SendPrice(ctx context.Context, pub PricePublisher) {
+	if len(rg.frames) == 0 {
+		return
+	}
+
+	// Looping back to the start waits as long as the first recorded gap,
+	// so the last and the first frame are not sent at once.
+	loopGap := time.Duration(0)
+	if len(rg.frames) > 1 {
+		loopGap = rg.frames[1].offset
+	}
+
+	for {
+		if rg.next == len(rg.frames) {
+			if !rg.loop || len(rg.frames) < 2 {
+				return
+			}
+			rg.next = 0
+			rg.prevOffset = -loopGap
+		}
+		frame := rg.frames[rg.next]
+
+		wait := time.Duration(float64(frame.offset-rg.prevOffset) / rg.speed)
+		select {
+		case <-ctx.Done():
+			return
+		case <-rg.clock.After(wait):
+		}
+
+		newPrice := rg.priceSource.GetPrice().Copy()
+		newPrice.Time = rg.clock.Now()
+		newPrice.Capped = nil
+		for k, v := range frame.prices {
+			newPrice.Prices[k] = v
+		}
+		ClampPriceCaps(rg.priceSource.GetPriceCaps(), &newPrice, rg.priceSource.GetRegions())
+
+		if err := pub.PublishPrice(ctx, newPrice); err != nil {
+			return
+		}
+		rg.prevOffset = frame.offset
+		rg.next++
+	}
+}
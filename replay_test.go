@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakePriceSource struct {
+	price GasPrices
+	caps  []*PriceCap
+}
+
+func (s *fakePriceSource) GetPrice() GasPrices {
+	return s.price.Copy()
+}
+
+func (s *fakePriceSource) GetRegions() []string {
+	return []string{"zagreb"}
+}
+
+func (s *fakePriceSource) GetPriceCaps() []*PriceCap {
+	return s.caps
+}
+
+type chanPublisher chan GasPrices
+
+func (p chanPublisher) PublishPrice(ctx context.Context, price GasPrices) error {
+	select {
+	case p <- price:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+const replayCSV = `station,fuel,price,timestamp
+Zagreb,diesel,1.40,2024-03-01T08:00:00Z
+Zagreb,gasoline,1.50,2024-03-01T08:00:00Z
+Zagreb,diesel,1.41,2024-03-01T08:10:00Z
+Zagreb,diesel,1.60,2024-03-01T08:20:00Z
+Split,diesel,1.70,2024-03-01T08:00:00Z
+`
+
+func newTestReplay(t *testing.T, source *fakePriceSource, clock Clock, loop bool) *ReplayPriceGen {
+	t.Helper()
+	points, err := ParseReplayCSV(strings.NewReader(replayCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeline := NewReplayTimeline(points)
+	stationPoints := timeline.ForStation(1, "Zagreb", []GasType{"diesel", "gasoline"})
+	return NewReplayPriceGen(stationPoints, source, clock, 2, loop)
+}
+
+// nextReplayPrice advances the clock a minute at a time until the
+// generator publishes.
+func nextReplayPrice(t *testing.T, clock *ManualClock, prices chanPublisher) GasPrices {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-prices:
+			return p
+		case <-deadline:
+			t.Fatal("Replay did not publish a price")
+		case <-time.After(time.Millisecond):
+			clock.Advance(time.Minute)
+		}
+	}
+}
+
+func TestParseReplayJSONL(t *testing.T) {
+	input := `{"station": 12, "fuel": "diesel", "price": 1.4, "timestamp": "2024-03-01T08:00:00Z"}
+
+{"station": "Split", "fuel": "gasoline", "price": 1.5, "timestamp": "2024-03-01T08:05:00Z"}
+`
+	points, err := ParseReplayJSONL(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 2 || points[0].Station != "12" || points[1].Station != "Split" {
+		t.Fatalf("Unexpected points %+v", points)
+	}
+
+	if _, err := ParseReplayJSONL(strings.NewReader(`{"station": 1, "fuel": "diesel", "price": -1, "timestamp": "2024-03-01T08:00:00Z"}`)); err == nil {
+		t.Fatal("Negative price was accepted")
+	}
+}
+
+func TestReplayFollowsTimeline(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	source := &fakePriceSource{price: GasPrices{Prices: map[GasType]float64{"diesel": 1, "gasoline": 1}}}
+	gen := newTestReplay(t, source, clock, true)
+
+	prices := make(chanPublisher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go gen.SendPrice(ctx, prices)
+
+	want := []float64{1.40, 1.41, 1.60, 1.40}
+	for i, w := range want {
+		p := nextReplayPrice(t, clock, prices)
+		source.price = p
+		if p.Prices["diesel"] != w {
+			t.Fatalf("Frame %d: diesel %.2f, want %.2f", i, p.Prices["diesel"], w)
+		}
+		if p.Prices["gasoline"] != 1.50 {
+			t.Fatalf("Frame %d: gasoline %.2f was not carried over", i, p.Prices["gasoline"])
+		}
+	}
+}
+
+func TestReplayClampsPriceCaps(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	source := &fakePriceSource{
+		price: GasPrices{Prices: map[GasType]float64{"diesel": 1, "gasoline": 1}},
+		caps:  []*PriceCap{{ID: 1, GasType: "diesel", MaxPrice: 1.45, Region: "zagreb"}},
+	}
+	gen := newTestReplay(t, source, clock, false)
+
+	prices := make(chanPublisher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go gen.SendPrice(ctx, prices)
+
+	nextReplayPrice(t, clock, prices)
+	nextReplayPrice(t, clock, prices)
+	p := nextReplayPrice(t, clock, prices)
+	if p.Prices["diesel"] != 1.45 {
+		t.Fatalf("Diesel %.2f was not clamped to the cap", p.Prices["diesel"])
+	}
+	if len(p.Capped) != 1 || p.Capped[0] != "diesel" {
+		t.Fatalf("Clamped price is not flagged: %v", p.Capped)
+	}
+}
+
+func TestReplayResumesWhereItPaused(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	source := &fakePriceSource{price: GasPrices{Prices: map[GasType]float64{"diesel": 1, "gasoline": 1}}}
+	gen := newTestReplay(t, source, clock, false)
+
+	prices := make(chanPublisher)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		gen.SendPrice(ctx, prices)
+		close(done)
+	}()
+	if p := nextReplayPrice(t, clock, prices); p.Prices["diesel"] != 1.40 {
+		t.Fatalf("First frame diesel %.2f", p.Prices["diesel"])
+	}
+	clock.BlockUntil(1)
+	cancel()
+	<-done
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go gen.SendPrice(ctx, prices)
+	if p := nextReplayPrice(t, clock, prices); p.Prices["diesel"] != 1.41 {
+		t.Fatalf("Resumed replay sent diesel %.2f, want the second frame", p.Prices["diesel"])
+	}
+}
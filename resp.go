@@ -0,0 +1,508 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// respError is an error reply sent by the server.
+type respError string
+
+func (e respError) Error() string {
+	return string(e)
+}
+
+// respConn speaks RESP, the Redis protocol. Replies are decoded as string,
+// int64, []interface{}, nil for null replies or respError.
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func dialRESP(addr string) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return newRESPConn(conn), nil
+}
+
+func newRESPConn(conn net.Conn) *respConn {
+	return &respConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+}
+
+func (c *respConn) Send(args ...string) error {
+	if err := writeRESPArray(c.w, args); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+func (c *respConn) Receive() (interface{}, error) {
+	return readRESP(c.r)
+}
+
+// Do sends a command and returns its reply, error replies are returned as
+// the error.
+func (c *respConn) Do(args ...string) (interface{}, error) {
+	if err := c.Send(args...); err != nil {
+		return nil, err
+	}
+	reply, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(respError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func (c *respConn) Close() error {
+	return c.conn.Close()
+}
+
+func writeRESPArray(w *bufio.Writer, args []string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("Invalid RESP line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("Empty RESP line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid RESP integer %q", line)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid RESP bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid RESP array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("Unknown RESP type %q", line[0])
+}
+
+// RESPServer is a small in-process stand-in for Redis. It implements just
+// the pub/sub, key and transaction commands the broker and the leader
+// lease use, so several local instances can share them without Redis.
+type RESPServer struct {
+	ln       net.Listener
+	channels map[string]map[*respClient]bool
+	data     map[string]*respEntry
+	versions map[string]uint64
+	mu       sync.Mutex
+}
+
+type respEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+// respClient is one connection. watched and queued belong to its read
+// loop, queued is non-nil inside MULTI.
+type respClient struct {
+	conn     *respConn
+	channels map[string]bool
+	watched  map[string]uint64
+	queued   [][]string
+	mu       sync.Mutex
+}
+
+func NewRESPServer(addr string) (*RESPServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &RESPServer{
+		ln:       ln,
+		channels: make(map[string]map[*respClient]bool),
+		data:     make(map[string]*respEntry),
+		versions: make(map[string]uint64),
+	}, nil
+}
+
+func (s *RESPServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *RESPServer) Close() error {
+	return s.ln.Close()
+}
+
+// Serve accepts connections until the server is closed.
+func (s *RESPServer) Serve() error {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	c := &respClient{
+		conn:     newRESPConn(conn),
+		channels: make(map[string]bool),
+	}
+	defer func() {
+		s.unsubscribe(c, nil)
+		conn.Close()
+	}()
+
+	for {
+		cmd, err := c.conn.Receive()
+		if err != nil {
+			return
+		}
+		args, ok := respStrings(cmd)
+		if !ok || len(args) == 0 {
+			c.reply(respError("ERR invalid command"))
+			continue
+		}
+
+		name := strings.ToUpper(args[0])
+		if c.queued != nil && name != "EXEC" && name != "DISCARD" {
+			if name != "GET" && name != "SET" && name != "DEL" {
+				c.reply(respError(fmt.Sprintf("ERR command '%s' not allowed in MULTI", args[0])))
+				continue
+			}
+			c.queued = append(c.queued, args)
+			c.reply("QUEUED")
+			continue
+		}
+
+		switch name {
+		case "GET", "SET", "DEL":
+			s.mu.Lock()
+			reply := s.execLocked(args)
+			s.mu.Unlock()
+			c.reply(reply)
+		case "WATCH":
+			s.mu.Lock()
+			if c.watched == nil {
+				c.watched = make(map[string]uint64)
+			}
+			for _, key := range args[1:] {
+				c.watched[key] = s.versionLocked(key)
+			}
+			s.mu.Unlock()
+			c.reply("OK")
+		case "UNWATCH":
+			c.watched = nil
+			c.reply("OK")
+		case "MULTI":
+			c.queued = make([][]string, 0)
+			c.reply("OK")
+		case "DISCARD":
+			if c.queued == nil {
+				c.reply(respError("ERR DISCARD without MULTI"))
+				continue
+			}
+			c.queued = nil
+			c.watched = nil
+			c.reply("OK")
+		case "EXEC":
+			if c.queued == nil {
+				c.reply(respError("ERR EXEC without MULTI"))
+				continue
+			}
+			c.reply(s.exec(c))
+		case "PING":
+			// Subscribed clients get pings as pushed messages like on Redis.
+			c.mu.Lock()
+			subscribed := len(c.channels) > 0
+			c.mu.Unlock()
+			if subscribed {
+				c.reply([]interface{}{"pong", ""})
+				continue
+			}
+			c.reply("PONG")
+		case "QUIT":
+			c.reply("OK")
+			return
+		case "PUBLISH":
+			if len(args) != 3 {
+				c.reply(respError("ERR wrong number of arguments for 'publish' command"))
+				continue
+			}
+			c.reply(s.publish(args[1], args[2]))
+		case "SUBSCRIBE":
+			if len(args) < 2 {
+				c.reply(respError("ERR wrong number of arguments for 'subscribe' command"))
+				continue
+			}
+			s.subscribe(c, args[1:])
+		case "UNSUBSCRIBE":
+			s.unsubscribe(c, args[1:])
+		default:
+			c.reply(respError(fmt.Sprintf("ERR unknown command '%s'", args[0])))
+		}
+	}
+}
+
+// exec runs the queued commands of a transaction, or none and returns nil
+// when a watched key changed since WATCH.
+func (s *RESPServer) exec(c *respClient) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queued, watched := c.queued, c.watched
+	c.queued, c.watched = nil, nil
+	for key, version := range watched {
+		if s.versionLocked(key) != version {
+			return nil
+		}
+	}
+	replies := make([]interface{}, len(queued))
+	for i, args := range queued {
+		replies[i] = s.execLocked(args)
+	}
+	return replies
+}
+
+// versionLocked returns the number of changes of the key, expiring it
+// counts as a change.
+func (s *RESPServer) versionLocked(key string) uint64 {
+	if e, ok := s.data[key]; ok && !e.expiresAt.IsZero() && !time.Now().Before(e.expiresAt) {
+		delete(s.data, key)
+		s.versions[key]++
+	}
+	return s.versions[key]
+}
+
+// execLocked runs GET key, SET key value [NX|XX] [PX ms] or DEL key...
+func (s *RESPServer) execLocked(args []string) interface{} {
+	name := strings.ToUpper(args[0])
+	switch {
+	case name == "GET" && len(args) == 2:
+		s.versionLocked(args[1])
+		if e, ok := s.data[args[1]]; ok {
+			return e.value
+		}
+		return nil
+	case name == "SET" && len(args) >= 3:
+		key := args[1]
+		s.versionLocked(key)
+		_, exists := s.data[key]
+		entry := &respEntry{value: args[2]}
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if exists {
+					return nil
+				}
+			case "XX":
+				if !exists {
+					return nil
+				}
+			case "PX":
+				if i+1 == len(args) {
+					return respError("ERR syntax error")
+				}
+				ms, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil || ms <= 0 {
+					return respError("ERR invalid expire time in 'set' command")
+				}
+				entry.expiresAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+				i++
+			default:
+				return respError("ERR syntax error")
+			}
+		}
+		s.data[key] = entry
+		s.versions[key]++
+		return "OK"
+	case name == "DEL" && len(args) >= 2:
+		deleted := int64(0)
+		for _, key := range args[1:] {
+			s.versionLocked(key)
+			if _, ok := s.data[key]; ok {
+				delete(s.data, key)
+				s.versions[key]++
+				deleted++
+			}
+		}
+		return deleted
+	}
+	return respError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+}
+
+func (s *RESPServer) publish(channel, message string) int64 {
+	s.mu.Lock()
+	clients := make([]*respClient, 0, len(s.channels[channel]))
+	for c := range s.channels[channel] {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range clients {
+		c.reply([]interface{}{"message", channel, message})
+	}
+	return int64(len(clients))
+}
+
+func (s *RESPServer) subscribe(c *respClient, channels []string) {
+	for _, ch := range channels {
+		s.mu.Lock()
+		if s.channels[ch] == nil {
+			s.channels[ch] = make(map[*respClient]bool)
+		}
+		s.channels[ch][c] = true
+		s.mu.Unlock()
+
+		c.mu.Lock()
+		c.channels[ch] = true
+		count := int64(len(c.channels))
+		c.mu.Unlock()
+		c.reply([]interface{}{"subscribe", ch, count})
+	}
+}
+
+// unsubscribe removes the client from the channels, or from all of its
+// channels when none are given.
+func (s *RESPServer) unsubscribe(c *respClient, channels []string) {
+	if len(channels) == 0 {
+		c.mu.Lock()
+		for ch := range c.channels {
+			channels = append(channels, ch)
+		}
+		c.mu.Unlock()
+	}
+	for _, ch := range channels {
+		s.mu.Lock()
+		delete(s.channels[ch], c)
+		if len(s.channels[ch]) == 0 {
+			delete(s.channels, ch)
+		}
+		s.mu.Unlock()
+
+		c.mu.Lock()
+		delete(c.channels, ch)
+		count := int64(len(c.channels))
+		c.mu.Unlock()
+		c.reply([]interface{}{"unsubscribe", ch, count})
+	}
+}
+
+// reply writes a value, pushed messages and command replies come from
+// different goroutines so writes are serialized. Write errors are ignored,
+// the read loop notices the broken connection.
+func (c *respClient) reply(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := writeRESPValue(c.conn.w, v); err == nil {
+		c.conn.w.Flush()
+	}
+}
+
+func writeRESPValue(w *bufio.Writer, v interface{}) error {
+	var err error
+	switch v := v.(type) {
+	case nil:
+		_, err = w.WriteString("$-1\r\n")
+	case respError:
+		_, err = fmt.Fprintf(w, "-%s\r\n", v)
+	case int64:
+		_, err = fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		_, err = fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		if _, err = fmt.Fprintf(w, "*%d\r\n", len(v)); err != nil {
+			return err
+		}
+		for _, e := range v {
+			if err = writeRESPValue(w, e); err != nil {
+				return err
+			}
+		}
+	default:
+		err = fmt.Errorf("Unsupported RESP value %T", v)
+	}
+	return err
+}
+
+func respStrings(v interface{}) ([]string, bool) {
+	values, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	strs := make([]string, len(values))
+	for i, e := range values {
+		if strs[i], ok = e.(string); !ok {
+			return nil, false
+		}
+	}
+	return strs, true
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+var statsPercentiles = []float64{10, 25, 75, 90, 95}
+
+type StationRefDto struct {
+	ID      uint64  `json:"id"`
+	Name    string  `json:"name"`
+	Address string  `json:"address"`
+	Price   float64 `json:"price"`
+}
+
+type PriceStatsDto struct {
+	GasType     GasType            `json:"gas_type"`
+	Count       int                `json:"count"`
+	Min         float64            `json:"min"`
+	Max         float64            `json:"max"`
+	Mean        float64            `json:"mean"`
+	Median      float64            `json:"median"`
+	Percentiles map[string]float64 `json:"percentiles"`
+	MinStation  *StationRefDto     `json:"min_station"`
+	MaxStation  *StationRefDto     `json:"max_station"`
+}
+
+type AvgPriceBucketDto struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Avg      float64   `json:"avg"`
+	Min      float64   `json:"min"`
+	Max      float64   `json:"max"`
+	Stations int       `json:"stations"`
+}
+
+func NewStationRefDto(st *Station, price float64) *StationRefDto {
+	return &StationRefDto{
+		ID:      st.ID,
+		Name:    st.Name,
+		Address: st.Address,
+		Price:   price,
+	}
+}
+
+// ComputePriceStats summarizes the current price of one gas type over the
+// given stations, stations that do not sell it are skipped.
+func ComputePriceStats(stations []*Station, gt GasType) *PriceStatsDto {
+	stats := &PriceStatsDto{
+		GasType:     gt,
+		Percentiles: make(map[string]float64),
+	}
+
+	prices := make([]float64, 0, len(stations))
+	sum := 0.0
+	for _, st := range stations {
+		p, ok := st.CurrentPrice.Prices[gt]
+		if !ok {
+			continue
+		}
+		if stats.MinStation == nil || p < stats.Min {
+			stats.Min = p
+			stats.MinStation = NewStationRefDto(st, p)
+		}
+		if stats.MaxStation == nil || p > stats.Max {
+			stats.Max = p
+			stats.MaxStation = NewStationRefDto(st, p)
+		}
+		prices = append(prices, p)
+		sum += p
+	}
+
+	stats.Count = len(prices)
+	if stats.Count == 0 {
+		return stats
+	}
+
+	sort.Float64s(prices)
+	stats.Mean = sum / float64(stats.Count)
+	stats.Median = percentile(prices, 50)
+	for _, p := range statsPercentiles {
+		stats.Percentiles[fmt.Sprintf("p%g", p)] = percentile(prices, p)
+	}
+	return stats
+}
+
+// percentile interpolates linearly between the closest ranks of a sorted
+// slice.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+	return sorted[lo] + (sorted[hi]-sorted[lo])*(rank-float64(lo))
+}
+
+func stationFuels(stations []*Station) []GasType {
+	seen := make(map[GasType]bool)
+	fuels := make([]GasType, 0)
+	for _, st := range stations {
+		for _, f := range st.SupportedFuel {
+			if !seen[f] {
+				seen[f] = true
+				fuels = append(fuels, f)
+			}
+		}
+	}
+	sort.Slice(fuels, func(i, j int) bool {
+		return fuels[i] < fuels[j]
+	})
+	return fuels
+}
+
+// ComputeAveragePriceHistory averages each station within a bucket first
+// and then averages the stations, so a station with many samples does not
+// outweigh the others.
+func ComputeAveragePriceHistory(stations []*Station, gt GasType, from, to time.Time, size time.Duration) []*AvgPriceBucketDto {
+	byStart := make(map[time.Time]*AvgPriceBucketDto)
+	for _, st := range stations {
+		hist := historyRange(st.PricesHistory, from, to)
+		points := make([]PricePointDto, 0, len(hist)+1)
+		for _, gp := range hist {
+			if p, ok := gp.Prices[gt]; ok {
+				points = append(points, PricePointDto{Time: gp.Time, Price: p})
+			}
+		}
+		if p, ok := st.CurrentPrice.Prices[gt]; ok && inTimeRange(st.CurrentPrice.Time, from, to) {
+			points = append(points, PricePointDto{Time: st.CurrentPrice.Time, Price: p})
+		}
+
+		for _, b := range AggregatePricePoints(points, size) {
+			agg, ok := byStart[b.Start]
+			if !ok {
+				agg = &AvgPriceBucketDto{
+					Start: b.Start,
+					End:   b.End,
+					Min:   b.Avg,
+					Max:   b.Avg,
+				}
+				byStart[b.Start] = agg
+			}
+			agg.Avg += b.Avg
+			agg.Stations++
+			if b.Avg < agg.Min {
+				agg.Min = b.Avg
+			}
+			if b.Avg > agg.Max {
+				agg.Max = b.Avg
+			}
+		}
+	}
+
+	buckets := make([]*AvgPriceBucketDto, 0, len(byStart))
+	for _, b := range byStart {
+		b.Avg /= float64(b.Stations)
+		buckets = append(buckets, b)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets
+}
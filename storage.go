@@ -1,41 +1,118 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"sync"
 	"time"
     "os"
+    "slices"
     "sort"
+    "strings"
 )
 
 type Storage interface {
-	CreateUser(*UserDto) error
-	DeleteUser(uint64) error
-	UpdateUser(uint64, *UserDto) (*User, error)
+	CreateUser(*UserDto) (*User, error)
+	DeleteUser(uint64, uint64) (*User, error)
+	UpdateUser(uint64, uint64, *UserDto) (*User, *User, error)
 	GetUsers() ([]*User, error)
 	GetUserByID(uint64) (*User, error)
 	GetUserByEmail(string) (*User, error)
+	SetUserBrand(uint64, uint64) (*User, *User, error)
 
-	CreateStation(*StationDto) error
-	DeleteStation(uint64) error
-	UpdateStation(uint64, *StationDto) error
-	GetStations() ([]*Station, error)
-	GetStationByID(uint64) (*Station, error)
+	CreateStation(*StationDto) (*Station, error)
+	CreateStations([]*StationDto) ([]uint64, error)
+	UpsertStationByExternalID(*StationDto) (*Station, *Station, error)
+	DeleteStation(uint64, uint64) (*Station, error)
+	UpdateStation(uint64, uint64, *StationDto) (*StationView, *StationView, error)
+	GetStations(*StationFilter) ([]*StationView, error)
+	GetStationByID(uint64) (*StationView, error)
 
-	GetHistoryPrices(uint64, string) (*HistPriceGasTypeDto, error)
-	GetPricesByLocation(*Location) ([]*StationPriceLocDto, error)
+	GetDeletedStations() ([]*Station, error)
+	GetDeletedUsers() ([]*User, error)
+	RestoreStation(uint64) (*StationView, error)
+	RestoreUser(uint64) (*User, error)
+	PurgeDeleted(time.Time) ([]*Station, []*User, error)
+
+	CreateBrand(*BrandDto) (*Brand, error)
+	UpdateBrand(uint64, *BrandDto) (*Brand, error)
+	UpsertBrandByExternalID(*BrandDto) (*Brand, error)
+	DeleteBrand(uint64) error
+	GetBrands() ([]*Brand, error)
+	GetBrandByID(uint64) (*Brand, error)
+	RecordBrandPrice(uint64, map[GasType]float64) ([]*PriceChange, error)
+	GetBrandPriceStats(*StationFilter, string) ([]*BrandPriceStatsDto, error)
+
+	CreateFuelType(*FuelTypeDto) (*FuelType, error)
+	UpdateFuelType(GasType, *FuelTypeDto) (*FuelType, error)
+	DeleteFuelType(GasType) error
+	GetFuelTypes() ([]*FuelType, error)
+	GetFuelType(GasType) (*FuelType, error)
+	ValidFuelType(GasType) bool
+
+	CreateRegion(*RegionDto) (*Region, error)
+	UpdateRegion(uint64, *RegionDto) (*Region, error)
+	DeleteRegion(uint64) error
+	GetRegions() ([]*Region, error)
+	GetRegionByID(uint64) (*Region, error)
+	GetRegionsForLocation(*Location) ([]string, error)
+
+	GetCurrentPrice(uint64) (GasPrices, error)
+	GetStationRegions(uint64) ([]string, error)
+	RecordPrice(uint64, GasPrices) error
+	SubmitPrices(uint64, uint64, map[GasType]float64) (GasPrices, GasPrices, error)
+	GetHistoryPrices(uint64, string, time.Time, time.Time) ([]PricePointDto, error)
+	CompactHistory(*RetentionPolicy) (*CompactionStatsDto, error)
+	GetPricesByLocation(*Location, *StationFilter) ([]*StationPriceLocDto, error)
+	GetPriceStats(*StationFilter, string) ([]*PriceStatsDto, error)
+	GetAveragePriceHistory(*StationFilter, string, time.Time, time.Time, time.Duration) ([]*AvgPriceBucketDto, error)
+
+	CreatePriceCap(*PriceCapDto) (*PriceCap, error)
+	DeletePriceCap(uint64) error
+	GetPriceCaps() ([]*PriceCap, error)
+	GetActivePriceCaps() ([]*PriceCap, error)
+}
+
+// ErrVersionMismatch is returned when a write expects a version of the
+// resource other than the current one.
+var ErrVersionMismatch = errors.New("Resource was modified, version does not match")
+
+// ErrNotStationOperator is returned when a user submits prices for a
+// station of a brand they do not operate.
+var ErrNotStationOperator = errors.New("User is not an operator of the station's brand")
+
+// ErrStationDeleted is returned when an import matches a station in the
+// trash, imports never restore what an admin deleted.
+var ErrStationDeleted = errors.New("Station is deleted")
+
+// checkVersion accepts any version when expected is 0.
+func checkVersion(expected, current uint64) error {
+	if expected != 0 && expected != current {
+		return ErrVersionMismatch
+	}
+	return nil
 }
 
 type RAMStorage struct {
-	users    []*User
-	stations []*Station
-	mu       sync.Mutex
+	users      []*User
+	stations   []*Station
+	regions    []*Region
+	brands     []*Brand
+	fuelTypes  []*FuelType
+	priceCaps  []*PriceCap
+	sim        *SimConfig
+	rnd        *rand.Rand
+	supervisor *GeneratorSupervisor
+	market     *Market
+	events     *EventLog
+	mu         sync.Mutex
 }
 
-func NewRAMStorage() *RAMStorage {
-    id := generateId()
+func NewRAMStorage(sim *SimConfig, supervisor *GeneratorSupervisor, market *Market, events *EventLog) *RAMStorage {
+    rnd := sim.NewRand()
+    id := rnd.Uint64()
     uname := os.Getenv("ADMIN_UNAME")
     pass := os.Getenv("ADMIN_PASS")
     email := os.Getenv("ADMIN_EMAIL")
@@ -46,64 +123,91 @@ func NewRAMStorage() *RAMStorage {
 
     users := []*User{admin}
 	return &RAMStorage{
-		users:    users,
-		stations: make([]*Station, 0),
+		users:      users,
+		stations:   make([]*Station, 0),
+		regions:    make([]*Region, 0),
+		brands:     make([]*Brand, 0),
+		fuelTypes:  DefaultFuelTypes(),
+		priceCaps:  make([]*PriceCap, 0),
+		sim:        sim,
+		rnd:        rnd,
+		supervisor: supervisor,
+		market:     market,
+		events:     events,
 	}
 }
 
-func generateId() uint64 {
-	src := rand.NewSource(time.Now().UnixNano())
-	r := rand.New(src)
-	return r.Uint64()
+func (s *RAMStorage) generateId() uint64 {
+	return s.rnd.Uint64()
 }
 
-func (s *RAMStorage) CreateUser(u *UserDto) error {
+func (s *RAMStorage) CreateUser(u *UserDto) (*User, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	id := generateId()
+	id := s.generateId()
 	user, err := NewUser(id, u.Username, u.Password, u.Email)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	s.users = append(s.users, user)
-	return nil
+	return user.Copy(), nil
 }
 
-func (s *RAMStorage) DeleteUser(id uint64) error {
+// DeleteUser moves the user to the trash, see PurgeDeleted. It returns the
+// user as it was before.
+func (s *RAMStorage) DeleteUser(id uint64, version uint64) (*User, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i, u := range s.users {
-		if u.ID == id {
-			s.users = append(s.users[:i], s.users[i+1:]...)
-			return nil
+	for _, u := range s.users {
+		if u.ID == id && u.DeletedAt == nil {
+			if err := checkVersion(version, u.Version); err != nil {
+				return nil, err
+			}
+			before := u.Copy()
+			now := s.sim.Clock.Now()
+			u.DeletedAt = &now
+			u.Version++
+			return before, nil
 		}
 	}
 
-	return fmt.Errorf("User with id %d not found", id)
+	return nil, fmt.Errorf("User with id %d not found", id)
 }
-func (s *RAMStorage) UpdateUser(id uint64, user *UserDto) (*User, error) {
+// UpdateUser returns the user before and after the update.
+func (s *RAMStorage) UpdateUser(id uint64, version uint64, user *UserDto) (*User, *User, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	for _, u := range s.users {
-		if u.ID == id {
+		if u.ID == id && u.DeletedAt == nil {
+			if err := checkVersion(version, u.Version); err != nil {
+				return nil, nil, err
+			}
+			before := u.Copy()
+			u.Version++
 			u.Username = user.Username
 			u.CryptPassword = user.Password
 			u.Email = user.Email
-			return u, nil
+			return before, u.Copy(), nil
 		}
 	}
 
-	return nil, fmt.Errorf("User with id %d not found", id)
+	return nil, nil, fmt.Errorf("User with id %d not found", id)
 }
 
 func (s *RAMStorage) GetUsers() ([]*User, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.users, nil
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		if u.DeletedAt == nil {
+			users = append(users, u.Copy())
+		}
+	}
+	return users, nil
 }
 
 func (s *RAMStorage) GetUserByID(id uint64) (*User, error) {
@@ -111,8 +215,8 @@ func (s *RAMStorage) GetUserByID(id uint64) (*User, error) {
 	defer s.mu.Unlock()
 
 	for _, u := range s.users {
-		if u.ID == id {
-			return u, nil
+		if u.ID == id && u.DeletedAt == nil {
+			return u.Copy(), nil
 		}
 	}
 
@@ -124,24 +228,60 @@ func (s *RAMStorage) GetUserByEmail(email string) (*User, error) {
 	defer s.mu.Unlock()
 
 	for _, u := range s.users {
-		if u.Email == email {
-			return u, nil
+		if u.Email == email && u.DeletedAt == nil {
+			return u.Copy(), nil
 		}
 	}
 
 	return nil, fmt.Errorf("User with email %s not found", email)
 }
 
-func (s *RAMStorage) CreateStation(cst *StationDto) error {
+func (s *RAMStorage) CreateStation(cst *StationDto) (*Station, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	station, err := s.createStationLocked(cst)
+	if err != nil {
+		return nil, err
+	}
+	s.events.AppendShared(station.ID, station.ExternalID, station.CurrentPrice)
+	return station.Copy(), nil
+}
+
+// CreateStations creates every station or, if any of them fails, none.
+func (s *RAMStorage) CreateStations(csts []*StationDto) ([]uint64, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	id := generateId()
+	ids := make([]uint64, 0, len(csts))
+	for _, cst := range csts {
+		station, err := s.createStationLocked(cst)
+		if err != nil {
+			for _, id := range ids {
+				s.supervisor.Stop(id)
+			}
+			s.stations = s.stations[:len(s.stations)-len(ids)]
+			return nil, err
+		}
+		ids = append(ids, station.ID)
+	}
+	for _, st := range s.stations[len(s.stations)-len(ids):] {
+		s.events.AppendShared(st.ID, st.ExternalID, st.CurrentPrice)
+	}
+	return ids, nil
+}
+
+func (s *RAMStorage) createStationLocked(cst *StationDto) (*Station, error) {
+	if cst.BrandID != 0 && s.brandLocked(cst.BrandID) == nil {
+		return nil, fmt.Errorf("Brand with id %d not found", cst.BrandID)
+	}
+
+	id := s.generateId()
 	histP := make([]GasPrices, 0)
-    sCurrPrice := &GasPrices{
+    sCurrPrice := GasPrices{
         Prices: cst.CurrentPrice,
-        Time: time.Now(),
-    }
+        Time: s.sim.Clock.Now(),
+    }.Copy()
 
 	station := NewStation(
 		id,
@@ -149,46 +289,305 @@ func (s *RAMStorage) CreateStation(cst *StationDto) error {
 		cst.Address,
 		cst.SupportedFuel,
 		cst.Location,
-		*sCurrPrice,
+		sCurrPrice,
 		histP,
 	)
+	station.ExternalID = cst.ExternalID
+	station.BrandID = cst.BrandID
+	station.Hours = cst.Hours.Copy()
+	station.Amenities = cst.Amenities
+	station.EVConnectors = cst.EVConnectors
+	station.Regions = s.regionsForLocationLocked(&station.Location)
 
-	priceSource := NewStationPriceSource(station)
-	priceModifier := NewMCPriceGen(20 * time.Second, priceSource)
-	priceReceiver := NewStationPriceReceiver(station)
-
-	priceChan := make(chan GasPrices)
-	go priceModifier.SendPrice(priceChan)
-	go priceReceiver.ReceivePrice(priceChan)
+	if err := s.startGeneratorLocked(station); err != nil {
+		return nil, err
+	}
 
 	s.stations = append(s.stations, station)
-	return nil
+	return station, nil
+}
+
+// startGeneratorLocked starts the price generator of the station, replaying
+// recorded prices when the simulation has them for the station.
+func (s *RAMStorage) startGeneratorLocked(station *Station) error {
+	id := station.ID
+	stationRnd := rand.New(rand.NewSource(s.rnd.Int63()))
+	priceSource := NewStationPriceSource(id, s)
+	var priceModifier PriceModifier = NewMCPriceGen(s.sim.Interval, priceSource, s.sim.Clock, stationRnd, s.market)
+	if replay := s.sim.Replay; replay != nil {
+		if points := replay.Timeline.ForStation(id, station.Name, station.SupportedFuel); len(points) > 0 {
+			priceModifier = NewReplayPriceGen(points, priceSource, s.sim.Clock, replay.Speed, replay.Loop)
+		}
+	}
+	priceReceiver := NewStationPriceReceiver(id, s, s.sim.Clock)
+
+	return s.supervisor.Start(id, station.ExternalID, priceModifier, priceReceiver)
 }
 
-func (s *RAMStorage) DeleteStation(id uint64) error {
+// DeleteStation moves the station to the trash and stops its generator,
+// the price history is kept until PurgeDeleted removes the station. It
+// returns the station as it was before.
+func (s *RAMStorage) DeleteStation(id uint64, version uint64) (*Station, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i, st := range s.stations {
-		if st.ID == id {
-			s.stations = append(s.stations[:i], s.stations[i+1:]...)
-			return nil
+	for _, st := range s.stations {
+		if st.ID == id && st.DeletedAt == nil {
+			if err := checkVersion(version, st.Version); err != nil {
+				return nil, err
+			}
+			before := st.Copy()
+			now := s.sim.Clock.Now()
+			st.DeletedAt = &now
+			st.Version++
+			return before, s.supervisor.Stop(id)
 		}
 	}
 
-	return fmt.Errorf("Station with id %d not found", id)
+	return nil, fmt.Errorf("Station with id %d not found", id)
 }
 
-func (s *RAMStorage) UpdateStation(id uint64, station *StationDto) error {
+// UpdateStation replaces the station fields. Prices are kept when station
+// has none, and prices of fuels the station no longer supports are dropped.
+// A non zero version must match the current version of the station. It
+// returns the station before and after the update.
+func (s *RAMStorage) UpdateStation(id uint64, version uint64, station *StationDto) (*StationView, *StationView, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if station.BrandID != 0 && s.brandLocked(station.BrandID) == nil {
+		return nil, nil, fmt.Errorf("Brand with id %d not found", station.BrandID)
+	}
+
 	for _, st := range s.stations {
-		if st.ID == id {
+		if st.ID == id && st.DeletedAt == nil {
+			if err := checkVersion(version, st.Version); err != nil {
+				return nil, nil, err
+			}
+			before := s.viewLocked(st)
+			st.Version++
+			st.BrandID = station.BrandID
+			st.Hours = station.Hours.Copy()
+			st.Amenities = station.Amenities
+			st.EVConnectors = station.EVConnectors
 			st.Name = station.Name
 			st.Address = station.Address
 			st.SupportedFuel = station.SupportedFuel
 			st.Location = station.Location
+			st.Regions = s.regionsForLocationLocked(&st.Location)
+			s.reconcilePricesLocked(st, station.CurrentPrice)
+			return before, s.viewLocked(st), nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("Station with id %d not found", id)
+}
+
+// UpsertStationByExternalID creates the station if no station has its
+// external id yet, otherwise it updates it and records a new price when
+// any price differs from the current one. It returns the station before,
+// nil when it was created, and after the change. A station that would not
+// change is left alone and returned with the same version twice, one in
+// the trash fails with ErrStationDeleted.
+func (s *RAMStorage) UpsertStationByExternalID(cst *StationDto) (*Station, *Station, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cst.ExternalID == "" {
+		return nil, nil, fmt.Errorf("External id is required")
+	}
+	if cst.BrandID != 0 && s.brandLocked(cst.BrandID) == nil {
+		return nil, nil, fmt.Errorf("Brand with id %d not found", cst.BrandID)
+	}
+
+	for _, st := range s.stations {
+		if st.ExternalID != cst.ExternalID {
+			continue
+		}
+		if st.DeletedAt != nil {
+			return nil, nil, ErrStationDeleted
+		}
+
+		merged := st.Copy()
+		merged.BrandID = cst.BrandID
+		if cst.Hours != nil {
+			merged.Hours = cst.Hours.Copy()
+		}
+		merged.Name = cst.Name
+		merged.Address = cst.Address
+		merged.SupportedFuel = cst.SupportedFuel
+		merged.Location = cst.Location
+		changes, err := DiffJSON(st.Dto(), merged.Dto())
+		if err != nil {
+			return nil, nil, err
+		}
+		pricesChanged := !pricesEqual(st.CurrentPrice.Prices, cst.CurrentPrice)
+		if len(changes) == 0 && !pricesChanged {
+			return st.Copy(), st.Copy(), nil
+		}
+
+		before := st.Copy()
+		st.Version++
+		st.BrandID = merged.BrandID
+		st.Hours = merged.Hours
+		st.Name = merged.Name
+		st.Address = merged.Address
+		st.SupportedFuel = merged.SupportedFuel
+		st.Location = merged.Location
+		st.Regions = s.regionsForLocationLocked(&st.Location)
+
+		if pricesChanged {
+			st.PricesHistory = append(st.PricesHistory, st.CurrentPrice)
+			st.CurrentPrice = GasPrices{
+				Prices: cst.CurrentPrice,
+				Time:   s.sim.Clock.Now(),
+			}.Copy()
+			st.PriceVersion++
+			s.events.AppendShared(st.ID, st.ExternalID, st.CurrentPrice)
+		}
+		return before, st.Copy(), nil
+	}
+
+	station, err := s.createStationLocked(cst)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.events.AppendShared(station.ID, station.ExternalID, station.CurrentPrice)
+	return nil, station.Copy(), nil
+}
+
+// reconcilePricesLocked records prices, or the current prices when prices
+// is nil, limited to the supported fuels of st if they differ from the
+// current ones.
+func (s *RAMStorage) reconcilePricesLocked(st *Station, prices map[GasType]float64) {
+	if prices == nil {
+		prices = st.CurrentPrice.Prices
+	}
+
+	newPrices := make(map[GasType]float64)
+	for _, f := range st.SupportedFuel {
+		if p, ok := prices[f]; ok {
+			newPrices[f] = p
+		}
+	}
+	if pricesEqual(st.CurrentPrice.Prices, newPrices) {
+		return
+	}
+
+	st.PricesHistory = append(st.PricesHistory, st.CurrentPrice)
+	st.CurrentPrice = GasPrices{
+		Prices: newPrices,
+		Time:   s.sim.Clock.Now(),
+	}
+	st.PriceVersion++
+	s.events.AppendShared(st.ID, st.ExternalID, st.CurrentPrice)
+}
+
+func pricesEqual(a, b map[GasType]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *RAMStorage) GetStations(filter *StationFilter) ([]*StationView, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	filter = s.resolveFilterLocked(filter)
+	at := s.openStatusTimeLocked(filter)
+	stations := make([]*StationView, 0, len(s.stations))
+	for _, st := range s.filterStationsLocked(filter) {
+		stations = append(stations, &StationView{
+			Station: st.Copy(),
+			Open:    st.Hours.OpenAt(at),
+		})
+	}
+	return stations, nil
+}
+
+func (s *RAMStorage) GetStationByID(id uint64) (*StationView, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.stations {
+		if st.ID == id && st.DeletedAt == nil {
+			return s.viewLocked(st), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Station with id %d not found", id)
+}
+
+// StationIDByExternalID returns the id of the live station with the
+// external id, which replicas share while ids are generated per process.
+func (s *RAMStorage) StationIDByExternalID(externalID string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.stations {
+		if st.ExternalID == externalID && st.DeletedAt == nil {
+			return st.ID, true
+		}
+	}
+	return 0, false
+}
+
+// viewLocked copies the station with its open status now.
+func (s *RAMStorage) viewLocked(st *Station) *StationView {
+	return &StationView{
+		Station: st.Copy(),
+		Open:    st.Hours.OpenAt(s.sim.Clock.Now()),
+	}
+}
+
+func (s *RAMStorage) GetCurrentPrice(id uint64) (GasPrices, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.stations {
+		if st.ID == id && st.DeletedAt == nil {
+			return st.CurrentPrice.Copy(), nil
+		}
+	}
+
+	return GasPrices{}, fmt.Errorf("Station with id %d not found", id)
+}
+
+func (s *RAMStorage) GetStationRegions(id uint64) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.stations {
+		if st.ID == id && st.DeletedAt == nil {
+			regions := make([]string, len(st.Regions))
+			copy(regions, st.Regions)
+			return regions, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Station with id %d not found", id)
+}
+
+func (s *RAMStorage) RecordPrice(id uint64, price GasPrices) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.stations {
+		if st.ID == id && st.DeletedAt == nil {
+			newPrice := price.Copy()
+			if newPrice.Time.IsZero() {
+				newPrice.Time = s.sim.Clock.Now()
+			}
+			st.PricesHistory = append(st.PricesHistory, st.CurrentPrice)
+			st.CurrentPrice = newPrice
+			st.PriceVersion++
+			s.events.Append(st.ID, st.CurrentPrice)
 			return nil
 		}
 	}
@@ -196,74 +595,210 @@ func (s *RAMStorage) UpdateStation(id uint64, station *StationDto) error {
 	return fmt.Errorf("Station with id %d not found", id)
 }
 
-func (s *RAMStorage) GetStations() ([]*Station, error) {
+// SubmitPrices merges the submitted prices into the current price of the
+// station and returns the price before and after. The merge happens under
+// the lock so a generator tick in between is never overwritten. A brandID
+// other than 0 must match the brand of the station.
+func (s *RAMStorage) SubmitPrices(id, brandID uint64, prices map[GasType]float64) (GasPrices, GasPrices, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.stations, nil
+	for _, st := range s.stations {
+		if st.ID != id || st.DeletedAt != nil {
+			continue
+		}
+		if brandID != 0 && st.BrandID != brandID {
+			return GasPrices{}, GasPrices{}, ErrNotStationOperator
+		}
+
+		for k, v := range prices {
+			if v < 0 {
+				return GasPrices{}, GasPrices{}, fmt.Errorf("Invalid price, has negative value")
+			}
+			foundFuel := false
+			for _, fuel := range st.SupportedFuel {
+				if k == fuel {
+					foundFuel = true
+					break
+				}
+			}
+			if !foundFuel {
+				return GasPrices{}, GasPrices{}, fmt.Errorf("Fuel type not supported by station")
+			}
+		}
+
+		now := s.sim.Clock.Now()
+		caps := make([]*PriceCap, 0)
+		for _, c := range s.priceCaps {
+			if c.ActiveAt(now) {
+				caps = append(caps, c)
+			}
+		}
+		if err := ValidatePriceCaps(caps, prices, st.Regions); err != nil {
+			return GasPrices{}, GasPrices{}, err
+		}
+
+		newPrice := st.CurrentPrice.Copy()
+		newPrice.Time = now
+		newPrice.Capped = nil
+		newPrice.Resolution = ""
+		newPrice.Samples = 0
+		for k, v := range prices {
+			newPrice.Prices[k] = v
+		}
+
+		before := st.CurrentPrice.Copy()
+		st.PricesHistory = append(st.PricesHistory, st.CurrentPrice)
+		st.CurrentPrice = newPrice
+		st.PriceVersion++
+		s.events.AppendShared(st.ID, st.ExternalID, st.CurrentPrice)
+		return before, newPrice.Copy(), nil
+	}
+
+	return GasPrices{}, GasPrices{}, fmt.Errorf("Station with id %d not found", id)
 }
 
-func (s *RAMStorage) GetStationByID(id uint64) (*Station, error) {
+func (s *RAMStorage) GetHistoryPrices(id uint64, gasType string, from, to time.Time) ([]PricePointDto, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if !s.validFuelTypeLocked(GasType(gasType)) {
+		return nil, fmt.Errorf("Invalid gas type")
+	}
+	gt := GasType(gasType)
+
 	for _, st := range s.stations {
-		if st.ID == id {
-			return st, nil
+		if st.ID != id || st.DeletedAt != nil {
+			continue
+		}
+
+		supported := false
+		for _, sf := range st.SupportedFuel {
+			if sf == gt {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return nil, fmt.Errorf("Gas type not supported")
+		}
+
+		hist := historyRange(st.PricesHistory, from, to)
+		points := make([]PricePointDto, 0, len(hist)+1)
+		for _, gp := range hist {
+			if p, ok := gp.Prices[gt]; ok {
+				points = append(points, PricePointDto{Time: gp.Time, Price: p})
+			}
+		}
+		if p, ok := st.CurrentPrice.Prices[gt]; ok && inTimeRange(st.CurrentPrice.Time, from, to) {
+			points = append(points, PricePointDto{Time: st.CurrentPrice.Time, Price: p})
 		}
+		return points, nil
 	}
 
 	return nil, fmt.Errorf("Station with id %d not found", id)
 }
 
-func (s *RAMStorage) GetHistoryPrices(id uint64, gasType string) (*HistPriceGasTypeDto, error) {
-	histPrices := &HistPriceGasTypeDto{
-		HistoryPrices: make(map[time.Time]float64, 0),
+func (s *RAMStorage) CompactHistory(policy *RetentionPolicy) (*CompactionStatsDto, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.sim.Clock.Now()
+	total := new(CompactionStatsDto)
+	for _, st := range s.stations {
+		hist, stats := CompactPricesHistory(st.PricesHistory, policy, now)
+		if len(hist) != len(st.PricesHistory) {
+			st.PriceVersion++
+		}
+		st.PricesHistory = hist
+		total.add(stats)
 	}
-    
-	station, err := s.GetStationByID(id)
-	if err != nil {
-		return histPrices, err
+	return total, nil
+}
+
+// resolveFilterLocked turns open_now into an open_at of the simulation
+// clock, so open_now follows simulated time like the prices do.
+func (s *RAMStorage) resolveFilterLocked(filter *StationFilter) *StationFilter {
+	if filter == nil || !filter.OpenNow {
+		return filter
 	}
+	cp := *filter
+	cp.OpenNow = false
+	cp.OpenAt = s.sim.Clock.Now()
+	return &cp
+}
 
-	if !ValidGasType(gasType) {
-		return histPrices, fmt.Errorf("Invalid gas type")
+// openStatusTimeLocked is the time open status is reported for, the
+// requested open_at or else now.
+func (s *RAMStorage) openStatusTimeLocked(filter *StationFilter) time.Time {
+	if filter != nil && !filter.OpenAt.IsZero() {
+		return filter.OpenAt
 	}
+	return s.sim.Clock.Now()
+}
 
-	gt := GasType(gasType)
-	supported := false
-	for _, sf := range station.SupportedFuel {
-		if sf == gt {
-			supported = true
-			break
+func (s *RAMStorage) filterStationsLocked(filter *StationFilter) []*Station {
+	filter = s.resolveFilterLocked(filter)
+	stations := make([]*Station, 0, len(s.stations))
+	for _, st := range s.stations {
+		if st.DeletedAt == nil && filter.Matches(st) {
+			stations = append(stations, st)
+		}
+	}
+	return stations
+}
+
+func (s *RAMStorage) GetPriceStats(filter *StationFilter, gasType string) ([]*PriceStatsDto, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stations := s.filterStationsLocked(filter)
+
+	fuels := stationFuels(stations)
+	if gasType != "" {
+		if !s.validFuelTypeLocked(GasType(gasType)) {
+			return nil, fmt.Errorf("Invalid gas type")
 		}
+		fuels = []GasType{GasType(gasType)}
 	}
-	if !supported {
-		return histPrices, fmt.Errorf("Gas type not supported")
+
+	stats := make([]*PriceStatsDto, 0, len(fuels))
+	for _, f := range fuels {
+		stats = append(stats, ComputePriceStats(stations, f))
 	}
+	return stats, nil
+}
+
+func (s *RAMStorage) GetAveragePriceHistory(filter *StationFilter, gasType string, from, to time.Time, size time.Duration) ([]*AvgPriceBucketDto, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	for _, gp := range station.PricesHistory {
-		histPrices.HistoryPrices[gp.Time] = gp.Prices[gt]
+	if !s.validFuelTypeLocked(GasType(gasType)) {
+		return nil, fmt.Errorf("Invalid gas type")
 	}
 
-	return histPrices, nil
+	stations := s.filterStationsLocked(filter)
+	return ComputeAveragePriceHistory(stations, GasType(gasType), from, to, size), nil
 }
 
-func (s *RAMStorage) GetPricesByLocation(loc *Location) ([]*StationPriceLocDto, error) {
+func (s *RAMStorage) GetPricesByLocation(loc *Location, filter *StationFilter) ([]*StationPriceLocDto, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	filter = s.resolveFilterLocked(filter)
+	at := s.openStatusTimeLocked(filter)
 	slice := make([]*StationPriceLocDto, 0)
 
-	for _, st := range s.stations {
+	for _, st := range s.filterStationsLocked(filter) {
 		if len(slice) < 3 {
             newSt := NewStationPriceLocDto(
                 st.Name,
                 st.Address,
                 st.Location,
-                st.CurrentPrice.Prices,
+                st.CurrentPrice.Copy().Prices,
                 DistanceKm(&st.Location, loc),
             )
+            newSt.Open = st.Hours.OpenAt(at)
             slice = append(slice, newSt)
 			continue
 		}
@@ -274,8 +809,9 @@ func (s *RAMStorage) GetPricesByLocation(loc *Location) ([]*StationPriceLocDto,
                 ss.Name = st.Name
                 ss.Address = st.Address
                 ss.Location = st.Location
-                ss.CurrentPrice = st.CurrentPrice.Prices
+                ss.CurrentPrice = st.CurrentPrice.Copy().Prices
                 ss.Distance = d
+                ss.Open = st.Hours.OpenAt(at)
 				break
 			}
 		}
@@ -295,3 +831,644 @@ func (s *RAMStorage) GetPricesByLocation(loc *Location) ([]*StationPriceLocDto,
 	return slice, nil
 }
 
+
+func (s *RAMStorage) CreatePriceCap(dto *PriceCapDto) (*PriceCap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.validFuelTypeLocked(dto.GasType) {
+		return nil, fmt.Errorf("Invalid gas type")
+	}
+
+	priceCap, err := NewPriceCap(s.generateId(), dto)
+	if err != nil {
+		return nil, err
+	}
+	s.priceCaps = append(s.priceCaps, priceCap)
+
+	cp := *priceCap
+	return &cp, nil
+}
+
+func (s *RAMStorage) DeletePriceCap(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, c := range s.priceCaps {
+		if c.ID == id {
+			s.priceCaps = append(s.priceCaps[:i], s.priceCaps[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Price cap with id %d not found", id)
+}
+
+func (s *RAMStorage) GetPriceCaps() ([]*PriceCap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	caps := make([]*PriceCap, len(s.priceCaps))
+	for i, c := range s.priceCaps {
+		cp := *c
+		caps[i] = &cp
+	}
+	return caps, nil
+}
+
+func (s *RAMStorage) GetActivePriceCaps() ([]*PriceCap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.sim.Clock.Now()
+	caps := make([]*PriceCap, 0)
+	for _, c := range s.priceCaps {
+		if c.ActiveAt(now) {
+			cp := *c
+			caps = append(caps, &cp)
+		}
+	}
+	return caps, nil
+}
+
+func (s *RAMStorage) regionsForLocationLocked(loc *Location) []string {
+	codes := make([]string, 0)
+	for _, r := range s.regions {
+		if r.Contains(loc) {
+			codes = append(codes, r.Code)
+		}
+	}
+	return codes
+}
+
+func (s *RAMStorage) assignRegionsLocked() {
+	for _, st := range s.stations {
+		regions := s.regionsForLocationLocked(&st.Location)
+		if !slices.Equal(regions, st.Regions) {
+			st.Regions = regions
+			st.Version++
+		}
+	}
+}
+
+func (s *RAMStorage) CreateRegion(dto *RegionDto) (*Region, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.regions {
+		if r.Code == dto.Code {
+			return nil, fmt.Errorf("Region with code %s already exists", dto.Code)
+		}
+	}
+
+	region, err := NewRegion(s.generateId(), dto)
+	if err != nil {
+		return nil, err
+	}
+	s.regions = append(s.regions, region)
+	s.assignRegionsLocked()
+
+	cp := *region
+	return &cp, nil
+}
+
+func (s *RAMStorage) UpdateRegion(id uint64, dto *RegionDto) (*Region, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.regions {
+		if r.Code == dto.Code && r.ID != id {
+			return nil, fmt.Errorf("Region with code %s already exists", dto.Code)
+		}
+	}
+
+	for i, r := range s.regions {
+		if r.ID == id {
+			region, err := NewRegion(id, dto)
+			if err != nil {
+				return nil, err
+			}
+			s.regions[i] = region
+			s.assignRegionsLocked()
+
+			cp := *region
+			return &cp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Region with id %d not found", id)
+}
+
+func (s *RAMStorage) DeleteRegion(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, r := range s.regions {
+		if r.ID == id {
+			s.regions = append(s.regions[:i], s.regions[i+1:]...)
+			s.assignRegionsLocked()
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Region with id %d not found", id)
+}
+
+func (s *RAMStorage) GetRegions() ([]*Region, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	regions := make([]*Region, len(s.regions))
+	for i, r := range s.regions {
+		cp := *r
+		regions[i] = &cp
+	}
+	return regions, nil
+}
+
+func (s *RAMStorage) GetRegionByID(id uint64) (*Region, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, r := range s.regions {
+		if r.ID == id {
+			cp := *r
+			return &cp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Region with id %d not found", id)
+}
+
+func (s *RAMStorage) GetRegionsForLocation(loc *Location) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.regionsForLocationLocked(loc), nil
+}
+
+func (s *RAMStorage) validFuelTypeLocked(code GasType) bool {
+	for _, f := range s.fuelTypes {
+		if f.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *RAMStorage) ValidFuelType(code GasType) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.validFuelTypeLocked(code)
+}
+
+func (s *RAMStorage) CreateFuelType(dto *FuelTypeDto) (*FuelType, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.validFuelTypeLocked(dto.Code) {
+		return nil, fmt.Errorf("Fuel type %s already exists", dto.Code)
+	}
+
+	fuelType, err := NewFuelType(dto)
+	if err != nil {
+		return nil, err
+	}
+	s.fuelTypes = append(s.fuelTypes, fuelType)
+
+	cp := *fuelType
+	return &cp, nil
+}
+
+func (s *RAMStorage) UpdateFuelType(code GasType, dto *FuelTypeDto) (*FuelType, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dto.Code = code
+	for i, f := range s.fuelTypes {
+		if f.Code == code {
+			fuelType, err := NewFuelType(dto)
+			if err != nil {
+				return nil, err
+			}
+			s.fuelTypes[i] = fuelType
+
+			cp := *fuelType
+			return &cp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Fuel type %s not found", code)
+}
+
+func (s *RAMStorage) DeleteFuelType(code GasType) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.stations {
+		for _, f := range st.SupportedFuel {
+			if f == code {
+				return fmt.Errorf("Fuel type %s is supported by station with id %d", code, st.ID)
+			}
+		}
+	}
+
+	for i, f := range s.fuelTypes {
+		if f.Code == code {
+			s.fuelTypes = append(s.fuelTypes[:i], s.fuelTypes[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Fuel type %s not found", code)
+}
+
+func (s *RAMStorage) GetFuelTypes() ([]*FuelType, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fuelTypes := make([]*FuelType, len(s.fuelTypes))
+	for i, f := range s.fuelTypes {
+		cp := *f
+		fuelTypes[i] = &cp
+	}
+	return fuelTypes, nil
+}
+
+func (s *RAMStorage) GetFuelType(code GasType) (*FuelType, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, f := range s.fuelTypes {
+		if f.Code == code {
+			cp := *f
+			return &cp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Fuel type %s not found", code)
+}
+
+func (s *RAMStorage) SetUserBrand(id uint64, brandID uint64) (*User, *User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if brandID != 0 && s.brandLocked(brandID) == nil {
+		return nil, nil, fmt.Errorf("Brand with id %d not found", brandID)
+	}
+
+	for _, u := range s.users {
+		if u.ID == id && u.DeletedAt == nil {
+			before := u.Copy()
+			u.Version++
+			u.BrandID = brandID
+			return before, u.Copy(), nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("User with id %d not found", id)
+}
+
+func (s *RAMStorage) brandLocked(id uint64) *Brand {
+	for _, b := range s.brands {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+func (s *RAMStorage) CreateBrand(dto *BrandDto) (*Brand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	brand, err := NewBrand(s.generateId(), dto)
+	if err != nil {
+		return nil, err
+	}
+	s.brands = append(s.brands, brand)
+
+	cp := *brand
+	return &cp, nil
+}
+
+func (s *RAMStorage) UpdateBrand(id uint64, dto *BrandDto) (*Brand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, b := range s.brands {
+		if b.ID == id {
+			brand, err := NewBrand(id, dto)
+			if err != nil {
+				return nil, err
+			}
+			s.brands[i] = brand
+
+			cp := *brand
+			return &cp, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Brand with id %d not found", id)
+}
+
+// UpsertBrandByExternalID returns the brand with the external id of dto.
+// A brand an admin created by hand with the same name is linked to the
+// external id instead of creating a duplicate.
+func (s *RAMStorage) UpsertBrandByExternalID(dto *BrandDto) (*Brand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if dto.ExternalID == "" {
+		return nil, fmt.Errorf("External id is required")
+	}
+
+	for _, b := range s.brands {
+		if b.ExternalID == dto.ExternalID {
+			cp := *b
+			return &cp, nil
+		}
+	}
+	for _, b := range s.brands {
+		if b.ExternalID == "" && strings.EqualFold(b.Name, dto.Name) {
+			b.ExternalID = dto.ExternalID
+			cp := *b
+			return &cp, nil
+		}
+	}
+
+	brand, err := NewBrand(s.generateId(), dto)
+	if err != nil {
+		return nil, err
+	}
+	s.brands = append(s.brands, brand)
+
+	cp := *brand
+	return &cp, nil
+}
+
+func (s *RAMStorage) DeleteBrand(id uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.stations {
+		if st.BrandID == id && st.DeletedAt == nil {
+			return fmt.Errorf("Brand with id %d has station with id %d", id, st.ID)
+		}
+	}
+	for _, u := range s.users {
+		if u.BrandID == id && u.DeletedAt == nil {
+			return fmt.Errorf("Brand with id %d has operator with id %d", id, u.ID)
+		}
+	}
+
+	for i, b := range s.brands {
+		if b.ID == id {
+			s.brands = append(s.brands[:i], s.brands[i+1:]...)
+			// Stations and users in the trash are restored without it.
+			for _, st := range s.stations {
+				if st.BrandID == id {
+					st.BrandID = 0
+				}
+			}
+			for _, u := range s.users {
+				if u.BrandID == id {
+					u.BrandID = 0
+				}
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("Brand with id %d not found", id)
+}
+
+func (s *RAMStorage) GetBrands() ([]*Brand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	brands := make([]*Brand, len(s.brands))
+	for i, b := range s.brands {
+		cp := *b
+		brands[i] = &cp
+	}
+	return brands, nil
+}
+
+func (s *RAMStorage) GetBrandByID(id uint64) (*Brand, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if b := s.brandLocked(id); b != nil {
+		cp := *b
+		return &cp, nil
+	}
+
+	return nil, fmt.Errorf("Brand with id %d not found", id)
+}
+
+// RecordBrandPrice sets the prices on every station of the brand at once.
+// Stations get only the fuels they support, and if any price breaks an
+// active cap for some station no station is changed. It returns the price
+// change of every station it set.
+func (s *RAMStorage) RecordBrandPrice(id uint64, prices map[GasType]float64) ([]*PriceChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.brandLocked(id) == nil {
+		return nil, fmt.Errorf("Brand with id %d not found", id)
+	}
+
+	now := s.sim.Clock.Now()
+	caps := make([]*PriceCap, 0)
+	for _, c := range s.priceCaps {
+		if c.ActiveAt(now) {
+			caps = append(caps, c)
+		}
+	}
+
+	stations := make([]*Station, 0)
+	newPrices := make([]GasPrices, 0)
+	for _, st := range s.stations {
+		if st.BrandID != id || st.DeletedAt != nil {
+			continue
+		}
+
+		newPrice := st.CurrentPrice.Copy()
+		newPrice.Time = now
+		newPrice.Capped = nil
+		newPrice.Resolution = ""
+		newPrice.Samples = 0
+		changed := false
+		for _, f := range st.SupportedFuel {
+			if p, ok := prices[f]; ok {
+				newPrice.Prices[f] = p
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if err := ValidatePriceCaps(caps, newPrice.Prices, st.Regions); err != nil {
+			return nil, fmt.Errorf("Station with id %d: %v", st.ID, err)
+		}
+
+		stations = append(stations, st)
+		newPrices = append(newPrices, newPrice)
+	}
+
+	changes := make([]*PriceChange, len(stations))
+	for i, st := range stations {
+		changes[i] = &PriceChange{
+			StationID: st.ID,
+			Before:    st.CurrentPrice.Copy(),
+			After:     newPrices[i].Copy(),
+		}
+		st.PricesHistory = append(st.PricesHistory, st.CurrentPrice)
+		st.CurrentPrice = newPrices[i]
+		st.PriceVersion++
+		s.events.AppendShared(st.ID, st.ExternalID, st.CurrentPrice)
+	}
+	return changes, nil
+}
+
+// GetBrandPriceStats computes the price statistics of the filtered stations
+// separately for every brand.
+func (s *RAMStorage) GetBrandPriceStats(filter *StationFilter, gasType string) ([]*BrandPriceStatsDto, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gasType != "" && !s.validFuelTypeLocked(GasType(gasType)) {
+		return nil, fmt.Errorf("Invalid gas type")
+	}
+
+	stations := s.filterStationsLocked(filter)
+	brandStats := make([]*BrandPriceStatsDto, 0, len(s.brands))
+	for _, b := range s.brands {
+		brandStations := make([]*Station, 0)
+		for _, st := range stations {
+			if st.BrandID == b.ID {
+				brandStations = append(brandStations, st)
+			}
+		}
+		if len(brandStations) == 0 {
+			continue
+		}
+
+		fuels := stationFuels(brandStations)
+		if gasType != "" {
+			fuels = []GasType{GasType(gasType)}
+		}
+		stats := make([]*PriceStatsDto, 0, len(fuels))
+		for _, f := range fuels {
+			stats = append(stats, ComputePriceStats(brandStations, f))
+		}
+
+		brandStats = append(brandStats, &BrandPriceStatsDto{
+			BrandID:   b.ID,
+			BrandName: b.Name,
+			Stations:  len(brandStations),
+			Stats:     stats,
+		})
+	}
+	return brandStats, nil
+}
+
+func (s *RAMStorage) GetDeletedStations() ([]*Station, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stations := make([]*Station, 0)
+	for _, st := range s.stations {
+		if st.DeletedAt != nil {
+			stations = append(stations, st.Copy())
+		}
+	}
+	return stations, nil
+}
+
+func (s *RAMStorage) GetDeletedUsers() ([]*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := make([]*User, 0)
+	for _, u := range s.users {
+		if u.DeletedAt != nil {
+			users = append(users, u.Copy())
+		}
+	}
+	return users, nil
+}
+
+// RestoreStation takes the station out of the trash and restarts its
+// generator. Regions are reassigned since they may have changed meanwhile.
+func (s *RAMStorage) RestoreStation(id uint64) (*StationView, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, st := range s.stations {
+		if st.ID == id && st.DeletedAt != nil {
+			if err := s.startGeneratorLocked(st); err != nil {
+				return nil, err
+			}
+			st.DeletedAt = nil
+			st.Regions = s.regionsForLocationLocked(&st.Location)
+			st.Version++
+			return s.viewLocked(st), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Deleted station with id %d not found", id)
+}
+
+func (s *RAMStorage) RestoreUser(id uint64) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.ID == id && u.DeletedAt != nil {
+			for _, other := range s.users {
+				if other.DeletedAt == nil && other.Email == u.Email {
+					return nil, fmt.Errorf("User with email %s already exists", u.Email)
+				}
+			}
+			u.DeletedAt = nil
+			u.Version++
+			return u.Copy(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("Deleted user with id %d not found", id)
+}
+
+// PurgeDeleted permanently removes stations and users deleted before the
+// given time and returns them.
+func (s *RAMStorage) PurgeDeleted(before time.Time) ([]*Station, []*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purgedStations := make([]*Station, 0)
+	stations := make([]*Station, 0, len(s.stations))
+	for _, st := range s.stations {
+		if st.DeletedAt != nil && st.DeletedAt.Before(before) {
+			purgedStations = append(purgedStations, st.Copy())
+			continue
+		}
+		stations = append(stations, st)
+	}
+	s.stations = stations
+
+	purgedUsers := make([]*User, 0)
+	users := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		if u.DeletedAt != nil && u.DeletedAt.Before(before) {
+			purgedUsers = append(purgedUsers, u.Copy())
+			continue
+		}
+		users = append(users, u)
+	}
+	s.users = users
+
+	return purgedStations, purgedUsers, nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStorageConcurrentAccess is meant for go test -race. Writers record
+// prices while the generators tick and readers modify the snapshots they
+// get back, which must never alias the stored station.
+func TestStorageConcurrentAccess(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	sim := NewSimConfig(clock, 7)
+	storage, _ := newTestStorage(t, sim)
+
+	ids := make([]uint64, 0)
+	for i, name := range []string{"Zagreb", "Split", "Rijeka", "Osijek"} {
+		st, err := storage.CreateStation(testStationDto(name, 45+float64(i), 15+float64(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, st.ID)
+	}
+
+	const rounds = 200
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			clock.Advance(sim.Interval)
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				price := GasPrices{Prices: map[GasType]float64{
+					"diesel":   1.4 + float64(i)/1000,
+					"gasoline": 1.5 + float64(i)/1000,
+				}}
+				if err := storage.RecordPrice(id, price); err != nil {
+					t.Error(err)
+					return
+				}
+				price.Prices["diesel"] = 0
+			}
+		}(id)
+	}
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				stations, err := storage.GetStations(&StationFilter{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, st := range stations {
+					st.Name = "changed"
+					st.CurrentPrice.Prices["diesel"] = 0
+					for _, h := range st.PricesHistory {
+						h.Prices["gasoline"] = 0
+					}
+				}
+
+				id := ids[i%len(ids)]
+				st, err := storage.GetStationByID(id)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				st.CurrentPrice.Prices["gasoline"] = 0
+
+				points, err := storage.GetHistoryPrices(id, "diesel", time.Time{}, time.Time{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for j := range points {
+					points[j].Price = 0
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+
+	for _, id := range ids {
+		st, err := storage.GetStationByID(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Name == "changed" {
+			t.Fatalf("Station %d was changed through a snapshot", id)
+		}
+		if len(st.PricesHistory) < rounds {
+			t.Fatalf("Station %d recorded %d prices, want at least %d", id, len(st.PricesHistory), rounds)
+		}
+		for _, h := range append(st.PricesHistory, st.CurrentPrice) {
+			if h.Prices["diesel"] == 0 || h.Prices["gasoline"] == 0 {
+				t.Fatalf("Station %d has a price zeroed through a snapshot", id)
+			}
+		}
+	}
+}
+
+func TestSubmitPricesRequiresBrandOperator(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, _ := newTestStorage(t, NewSimConfig(clock, 7))
+
+	brand, err := storage.CreateBrand(&BrandDto{Name: "Petrol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dto := testStationDto("Zagreb", 45.8, 15.9)
+	dto.BrandID = brand.ID
+	st, err := storage.CreateStation(dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prices := map[GasType]float64{"diesel": 1.39}
+	if _, _, err := storage.SubmitPrices(st.ID, brand.ID+1, prices); !errors.Is(err, ErrNotStationOperator) {
+		t.Fatalf("Other brand submitted prices: %v", err)
+	}
+
+	before, after, err := storage.SubmitPrices(st.ID, brand.ID, prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Prices["diesel"] != 1.45 || after.Prices["diesel"] != 1.39 || after.Prices["gasoline"] != 1.52 {
+		t.Fatalf("Unexpected prices before %v and after %v", before.Prices, after.Prices)
+	}
+
+	if _, _, err := storage.SubmitPrices(st.ID, 0, map[GasType]float64{"lpg": 0.9}); err == nil {
+		t.Fatal("Unsupported fuel was accepted")
+	}
+}
+
+func TestDeletedStationHidesPrices(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, _ := newTestStorage(t, NewSimConfig(clock, 7))
+	st, err := storage.CreateStation(testStationDto("Zagreb", 45.8, 15.9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.DeleteStation(st.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := storage.GetCurrentPrice(st.ID); err == nil {
+		t.Fatal("Deleted station has a current price")
+	}
+	if _, err := storage.GetStationRegions(st.ID); err == nil {
+		t.Fatal("Deleted station has regions")
+	}
+	if _, err := storage.GetHistoryPrices(st.ID, "diesel", time.Time{}, time.Time{}); err == nil {
+		t.Fatal("Deleted station has a price history")
+	}
+}
+
+func TestMutationsReturnBeforeAndAfter(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, _ := newTestStorage(t, NewSimConfig(clock, 7))
+	brand, err := storage.CreateBrand(&BrandDto{Name: "Petrol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dto := testStationDto("Zagreb", 45.8, 15.9)
+	dto.BrandID = brand.ID
+	st, err := storage.CreateStation(dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dto.Name = "Zagreb 2"
+	before, after, err := storage.UpdateStation(st.ID, st.Version, dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Name != "Zagreb" || after.Name != "Zagreb 2" || after.Version != before.Version+1 {
+		t.Fatalf("Unexpected update before %s v%d and after %s v%d", before.Name, before.Version, after.Name, after.Version)
+	}
+
+	changes, err := storage.RecordBrandPrice(brand.ID, map[GasType]float64{"diesel": 1.30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].StationID != st.ID ||
+		changes[0].Before.Prices["diesel"] != 1.45 || changes[0].After.Prices["diesel"] != 1.30 {
+		t.Fatalf("Unexpected brand price changes %+v", changes)
+	}
+
+	deleted, err := storage.DeleteStation(st.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.DeletedAt != nil || deleted.Name != "Zagreb 2" {
+		t.Fatalf("Delete did not return the station before: %+v", deleted)
+	}
+}
+
+func TestSubmitBrandPricesForbidsOtherOperators(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, _ := newTestStorage(t, NewSimConfig(clock, 7))
+	server := &APIServer{storage: storage, audit: NewRAMAuditStore(clock)}
+
+	brand, err := storage.CreateBrand(&BrandDto{Name: "Petrol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := storage.CreateUser(&UserDto{Username: "operator", Password: "secret", Email: "operator@email.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := storage.SetUserBrand(user.ID, brand.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	other := strconv.FormatUint(brand.ID+1, 10)
+	r := httptest.NewRequest(http.MethodPost, "/brand/"+other+"/prices", strings.NewReader(`{"diesel": 1.39}`))
+	r.SetPathValue("id", other)
+	r.Header.Set("Authorization", "Bearer "+GenerateJwtToken(user.Email))
+	w := httptest.NewRecorder()
+	wrapApiHandleFunc(server.handleSubmitBrandPrices)(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("Operator of another brand got %d: %s", w.Code, w.Body)
+	}
+}
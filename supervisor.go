@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type GeneratorState string
+
+const (
+	GeneratorRunning GeneratorState = "running"
+	GeneratorPaused  GeneratorState = "paused"
+	GeneratorStandby GeneratorState = "standby"
+)
+
+type GeneratorStatusDto struct {
+	StationID uint64         `json:"station_id"`
+	State     GeneratorState `json:"state"`
+	StartedAt time.Time      `json:"started_at"`
+	UpdatedAt time.Time      `json:"updated_at"`
+}
+
+type generatorHandle struct {
+	stationID uint64
+	modifier  PriceModifier
+	receiver  PriceReceiver
+	publisher *stationPublisher
+	ctx       context.Context
+	cancel    context.CancelFunc
+	genCancel context.CancelFunc
+	genDone   chan struct{}
+	state     GeneratorState
+	startedAt time.Time
+	updatedAt time.Time
+}
+
+// GeneratorSupervisor owns the generator/receiver goroutine pair of every
+// station. The generator publishes on TopicPriceGenerated and the receiver
+// subscribes to its station only. Pausing only stops the generator, the
+// receiver keeps its subscription so the pair can be resumed. An inactive
+// supervisor only runs the receivers of shared stations, their generators
+// stand by until SetActive, e.g. on a replica that is not the leader.
+// Stations without an external id are only known here, so they always
+// generate their own prices.
+type GeneratorSupervisor struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	clock   Clock
+	broker  Broker
+	active  bool
+	handles map[uint64]*generatorHandle
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+}
+
+func NewGeneratorSupervisor(clock Clock, broker Broker) *GeneratorSupervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &GeneratorSupervisor{
+		ctx:     ctx,
+		cancel:  cancel,
+		clock:   clock,
+		broker:  broker,
+		active:  true,
+		handles: make(map[uint64]*generatorHandle),
+	}
+}
+
+type stationPublisher struct {
+	stationID  uint64
+	externalID string
+	broker     Broker
+}
+
+func (p *stationPublisher) PublishPrice(ctx context.Context, price GasPrices) error {
+	cp := price.Copy()
+	return p.broker.Publish(ctx, TopicPriceGenerated, &PriceEvent{
+		Time:       cp.Time,
+		StationID:  p.stationID,
+		ExternalID: p.externalID,
+		Prices:     cp.Prices,
+		Capped:     cp.Capped,
+		Shared:     true,
+	})
+}
+
+// Start runs the generator pair of the station, externalID is published
+// with its prices so replicas can tell which of their stations they are
+// for. It may be empty for stations only this instance knows.
+func (gs *GeneratorSupervisor) Start(id uint64, externalID string, pm PriceModifier, pr PriceReceiver) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.ctx.Err() != nil {
+		return fmt.Errorf("Generator supervisor is shut down")
+	}
+	if _, ok := gs.handles[id]; ok {
+		return fmt.Errorf("Generator for station with id %d already running", id)
+	}
+
+	// Blocking keeps generated prices from being lost, the generator
+	// waits for the receiver like it did on an unbuffered channel.
+	sub, err := gs.broker.Subscribe(TopicPriceGenerated, SubscribeOptions{
+		Filter: func(e *PriceEvent) bool {
+			return e.StationID == id
+		},
+		Buffer: 1,
+		Policy: OverflowBlock,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(gs.ctx)
+	now := gs.clock.Now()
+	h := &generatorHandle{
+		stationID: id,
+		modifier:  pm,
+		receiver:  pr,
+		publisher: &stationPublisher{stationID: id, externalID: externalID, broker: gs.broker},
+		ctx:       ctx,
+		cancel:    cancel,
+		startedAt: now,
+	}
+
+	gs.wg.Add(1)
+	go func() {
+		defer gs.wg.Done()
+		defer gs.broker.Unsubscribe(sub)
+		pr.ReceivePrice(ctx, sub)
+	}()
+	h.state = GeneratorRunning
+	h.updatedAt = now
+	if gs.generatesLocked(h) {
+		gs.startGeneratorLocked(h)
+	}
+
+	gs.handles[id] = h
+	return nil
+}
+
+// generatesLocked tells whether the generator of the station runs here
+// unless it is paused.
+func (gs *GeneratorSupervisor) generatesLocked(h *generatorHandle) bool {
+	return gs.active || h.publisher.externalID == ""
+}
+
+// startGeneratorLocked never waits for the generator it replaces, that one
+// may be blocked on the storage lock while the storage calls Start or Stop.
+func (gs *GeneratorSupervisor) startGeneratorLocked(h *generatorHandle) {
+	genCtx, genCancel := context.WithCancel(h.ctx)
+	prevDone := h.genDone
+	genDone := make(chan struct{})
+	h.genCancel = genCancel
+	h.genDone = genDone
+	h.state = GeneratorRunning
+	h.updatedAt = gs.clock.Now()
+
+	gs.wg.Add(1)
+	go func() {
+		defer gs.wg.Done()
+		defer close(genDone)
+		// A paused generator may still be finishing its last step, wait
+		// for it so two goroutines never share the same modifier.
+		if prevDone != nil {
+			<-prevDone
+		}
+		if genCtx.Err() != nil {
+			return
+		}
+		h.modifier.SendPrice(genCtx, h.publisher)
+	}()
+}
+
+func (gs *GeneratorSupervisor) Stop(id uint64) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	h, ok := gs.handles[id]
+	if !ok {
+		return fmt.Errorf("Generator for station with id %d not found", id)
+	}
+	h.cancel()
+	delete(gs.handles, id)
+	return nil
+}
+
+func (gs *GeneratorSupervisor) Pause(id uint64) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	h, ok := gs.handles[id]
+	if !ok {
+		return fmt.Errorf("Generator for station with id %d not found", id)
+	}
+	if h.state == GeneratorPaused {
+		return fmt.Errorf("Generator for station with id %d already paused", id)
+	}
+	stopGeneratorLocked(h)
+	h.state = GeneratorPaused
+	h.updatedAt = gs.clock.Now()
+	return nil
+}
+
+func stopGeneratorLocked(h *generatorHandle) {
+	if h.genCancel != nil {
+		h.genCancel()
+		h.genCancel = nil
+	}
+}
+
+func (gs *GeneratorSupervisor) Resume(id uint64) error {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	h, ok := gs.handles[id]
+	if !ok {
+		return fmt.Errorf("Generator for station with id %d not found", id)
+	}
+	if h.state == GeneratorRunning {
+		return fmt.Errorf("Generator for station with id %d already running", id)
+	}
+	if gs.generatesLocked(h) {
+		gs.startGeneratorLocked(h)
+		return nil
+	}
+	h.state = GeneratorRunning
+	h.updatedAt = gs.clock.Now()
+	return nil
+}
+
+// SetActive starts or stops the generators of the shared stations that are
+// not paused, the receivers keep running either way. It never waits for a
+// generator to finish its step.
+func (gs *GeneratorSupervisor) SetActive(active bool) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	if gs.active == active {
+		return
+	}
+	gs.active = active
+	for _, h := range gs.handles {
+		if h.state != GeneratorRunning || h.publisher.externalID == "" {
+			continue
+		}
+		if active {
+			gs.startGeneratorLocked(h)
+		} else {
+			stopGeneratorLocked(h)
+			h.updatedAt = gs.clock.Now()
+		}
+	}
+}
+
+func (gs *GeneratorSupervisor) Status() []*GeneratorStatusDto {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+
+	statuses := make([]*GeneratorStatusDto, 0, len(gs.handles))
+	for _, h := range gs.handles {
+		state := h.state
+		if state == GeneratorRunning && !gs.generatesLocked(h) {
+			state = GeneratorStandby
+		}
+		statuses = append(statuses, &GeneratorStatusDto{
+			StationID: h.stationID,
+			State:     state,
+			StartedAt: h.startedAt,
+			UpdatedAt: h.updatedAt,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].StartedAt.Before(statuses[j].StartedAt)
+	})
+	return statuses
+}
+
+// Shutdown cancels every generator and receiver and waits for them to
+// return or for ctx to expire, whichever comes first.
+func (gs *GeneratorSupervisor) Shutdown(ctx context.Context) error {
+	gs.mu.Lock()
+	gs.cancel()
+	gs.handles = make(map[uint64]*generatorHandle)
+	gs.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		gs.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("Timed out waiting for generators to stop")
+	}
+}
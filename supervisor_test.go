@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// stuckModifier ignores cancellation until released, like a generator
+// waiting on the storage lock in the middle of a step.
+type stuckModifier struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (m *stuckModifier) ModifyPrice(p float64) float64 {
+	return p
+}
+
+func (m *stuckModifier) SendPrice(ctx context.Context, pub PricePublisher) {
+	m.started <- struct{}{}
+	<-m.release
+}
+
+type idleReceiver struct{}
+
+func (idleReceiver) ReceivePrice(ctx context.Context, sub *Subscription) {
+	<-ctx.Done()
+}
+
+func TestSupervisorResumeDoesNotWaitForPausedGenerator(t *testing.T) {
+	gs := NewGeneratorSupervisor(NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)), NewMemoryBroker())
+	defer gs.Shutdown(context.Background())
+
+	m := &stuckModifier{started: make(chan struct{}, 2), release: make(chan struct{})}
+	if err := gs.Start(1, "", m, idleReceiver{}); err != nil {
+		t.Fatal(err)
+	}
+	<-m.started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := gs.Pause(1); err != nil {
+			t.Error(err)
+		}
+		if err := gs.Resume(1); err != nil {
+			t.Error(err)
+		}
+		// The supervisor stays usable while the old step is stuck.
+		if err := gs.Start(2, "", &stuckModifier{started: make(chan struct{}, 1), release: m.release}, idleReceiver{}); err != nil {
+			t.Error(err)
+		}
+		gs.SetActive(false)
+		gs.SetActive(true)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		close(m.release)
+		t.Fatal("Supervisor waited for the paused generator")
+	}
+
+	select {
+	case <-m.started:
+		t.Fatal("Resumed generator ran alongside the paused one")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(m.release)
+	select {
+	case <-m.started:
+	case <-time.After(time.Second):
+		t.Fatal("Resumed generator did not start")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+type PurgeStatsDto struct {
+	Stations int       `json:"stations"`
+	Users    int       `json:"users"`
+	LastRun  time.Time `json:"last_run,omitempty"`
+}
+
+type TrashDto struct {
+	Grace    string        `json:"grace"`
+	Stations []*Station    `json:"stations"`
+	Users    []*User       `json:"users"`
+	Last     PurgeStatsDto `json:"last_purge"`
+}
+
+// TrashPurger permanently removes stations and users that have been in the
+// trash for longer than the grace period.
+type TrashPurger struct {
+	storage  Storage
+	audit    AuditStore
+	grace    time.Duration
+	interval time.Duration
+	clock    Clock
+	last     PurgeStatsDto
+	mu       sync.Mutex
+}
+
+func NewTrashPurger(storage Storage, audit AuditStore, grace, interval time.Duration, clock Clock) *TrashPurger {
+	return &TrashPurger{
+		storage:  storage,
+		audit:    audit,
+		grace:    grace,
+		interval: interval,
+		clock:    clock,
+	}
+}
+
+func (tp *TrashPurger) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tp.clock.After(tp.interval):
+		}
+
+		if _, err := tp.RunOnce(AuditSystemActor, ""); err != nil {
+			log.Println("Failed to purge trash, err: ", err)
+		}
+	}
+}
+
+// RunOnce purges the trash and records an audit entry of every purged
+// station and user for actor.
+func (tp *TrashPurger) RunOnce(actor, ip string) (*PurgeStatsDto, error) {
+	now := tp.clock.Now()
+	stations, users, err := tp.storage.PurgeDeleted(now.Add(-tp.grace))
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range stations {
+		writeAudit(tp.audit, actor, ip, AuditPurge, "station", st.ID, st.Dto(), nil)
+	}
+	for _, u := range users {
+		writeAudit(tp.audit, actor, ip, AuditPurge, "user", u.ID, userAuditView(u), nil)
+	}
+	stats := &PurgeStatsDto{
+		Stations: len(stations),
+		Users:    len(users),
+		LastRun:  now,
+	}
+
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	tp.last = *stats
+	return stats, nil
+}
+
+func (tp *TrashPurger) Grace() time.Duration {
+	return tp.grace
+}
+
+func (tp *TrashPurger) Last() PurgeStatsDto {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	return tp.last
+}
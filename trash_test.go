@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrashPurgerAuditsPurges(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, _ := newTestStorage(t, NewSimConfig(clock, 7))
+	audit := NewRAMAuditStore(clock)
+	purger := NewTrashPurger(storage, audit, time.Hour, time.Hour, clock)
+
+	st, err := storage.CreateStation(testStationDto("Zagreb", 45.8, 15.9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := storage.CreateUser(&UserDto{Username: "ana", Password: "secret", Email: "ana@email.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.DeleteStation(st.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.DeleteUser(user.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+
+	stats, err := purger.RunOnce(AuditSystemActor, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Stations != 1 || stats.Users != 1 {
+		t.Fatalf("Unexpected purge stats %+v", stats)
+	}
+
+	page, err := audit.GetAuditEntries(&AuditFilter{Action: AuditPurge, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 {
+		t.Fatalf("Recorded %d purge entries, want 2", page.Total)
+	}
+	for _, e := range page.Entries {
+		if e.Actor != AuditSystemActor {
+			t.Fatalf("Purge entry has actor %q", e.Actor)
+		}
+		if e.Resource == "station" && e.ResourceID != st.ID || e.Resource == "user" && e.ResourceID != user.ID {
+			t.Fatalf("Unexpected purge entry %+v", e)
+		}
+	}
+}
+
+func TestDeleteBrandIgnoresTrashedReferences(t *testing.T) {
+	clock := NewManualClock(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC))
+	storage, _ := newTestStorage(t, NewSimConfig(clock, 7))
+
+	brand, err := storage.CreateBrand(&BrandDto{Name: "Petrol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dto := testStationDto("Zagreb", 45.8, 15.9)
+	dto.BrandID = brand.ID
+	st, err := storage.CreateStation(dto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteBrand(brand.ID); err == nil {
+		t.Fatal("Brand of a live station was deleted")
+	}
+
+	if _, err := storage.DeleteStation(st.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.DeleteBrand(brand.ID); err != nil {
+		t.Fatalf("Brand of a trashed station was not deleted: %v", err)
+	}
+	restored, err := storage.RestoreStation(st.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.BrandID != 0 {
+		t.Fatalf("Restored station still has the deleted brand %d", restored.BrandID)
+	}
+}